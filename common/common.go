@@ -1,6 +1,11 @@
 package common
 
 import (
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
 	"time"
 
@@ -9,25 +14,82 @@ import (
 	"github.com/wxcgeek/goflyway/pkg/trafficmon"
 )
 
+// DATA_DIR is the data directory of the default site, others are relative to the data directory of each site
 const (
-	DATA_IMAGES    = "data/images/"
-	DATA_LOGS      = "data/logs/"
-	DATA_MAIN      = "data/main.txt"
-	DATA_RECAPTCHA = "data/recaptcha.txt"
+	DATA_DIR       = "data/"
+	DATA_BACKUP    = "backup/"
+	DATA_IMAGES    = "images/"
+	DATA_LOGS      = "logs/"
+	DATA_MAIN      = "main.txt"
+	DATA_SNAPSHOT  = "main.txt.snapshot" // served as /data.bin
+	DATA_RECAPTCHA = "recaptcha.txt"
+	DATA_THUMBS    = "thumbs.txt" // the thumbnail queue
 )
 
+// Site is a forum hosted in this process, it has its own data directory, password (also the salt) and caches
+type Site struct {
+	*server.Forum
+	Host      string
+	Dir       string
+	Password  string
+	Prod      bool // off if the site uses the test password: no referer checks and shorter intervals
+	Images    *server.ImageQueue
+	ThrotIPID *lru.Cache
+	BadUsers  *lru.Cache
+	UUIDs     *lru.Cache
+	Archive   *lru.Cache
+}
+
+func NewSite(host, dir, password string) *Site {
+	if !strings.HasSuffix(dir, "/") {
+		dir += "/"
+	}
+	return &Site{
+		Host:      strings.ToLower(host),
+		Dir:       dir,
+		Password:  password,
+		BadUsers:  lru.NewCache(1024),
+		UUIDs:     lru.NewCache(1024),
+		Archive:   lru.NewCache(256),
+		ThrotIPID: lru.NewCache(256),
+	}
+}
+
 var (
-	Kforum     *server.Forum
-	Kiq        *server.ImageQueue
-	KthrotIPID *lru.Cache
-	KbadUsers  *lru.Cache
-	Kuuids     *lru.Cache
-	Karchive   *lru.Cache
-	Kprod      bool
-	Kpassword  string
-	Kstart     time.Time
-	Ktraffic   trafficmon.Survey
+	Ksites   = map[string]*Site{}
+	Kdefault *Site
+	Kstart   time.Time
+	Ktraffic trafficmon.Survey
 )
 
-var TopicFilter1 = func(t *server.Topic) bool { return !strings.HasPrefix(t.Subject, "!!") }
-var TopicFilter2 = func(t *server.Topic) bool { return strings.HasPrefix(t.Subject, "!!") }
+// SiteOf returns the site of the request by its Host header, or the default site if no one matches
+func SiteOf(r *http.Request) *Site {
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if s := Ksites[host]; s != nil {
+		return s
+	}
+	return Kdefault
+}
+
+// images uploaded by older versions have paths like 2019-Mar/28-15h/NAME_HASH.png,
+// newer ones are named by the SHA1 of their contents and stored in images/XX/ where XX is the first byte
+var rxImageHash = regexp.MustCompile(`^[0-9a-f]{40}\.[a-z]+$`)
+
+// ImageFile returns the file of the image path
+func (site *Site) ImageFile(path string) string {
+	if rxImageHash.MatchString(path) {
+		return filepath.Join(site.Dir, DATA_IMAGES, path[:2], path)
+	}
+	return filepath.Join(site.Dir, DATA_IMAGES, path)
+}
+
+// RemoveImage removes the image and its thumbnail, it is called when no post refers to the image
+func (site *Site) RemoveImage(img *server.Image) {
+	file := site.ImageFile(img.Path)
+	os.Remove(file)
+	os.Remove(server.ThumbFile(file, server.ThumbSmall))
+	os.Remove(server.ThumbFile(file, server.ThumbMedium))
+}
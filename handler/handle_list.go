@@ -4,6 +4,7 @@ package handler
 import (
 	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -13,7 +14,8 @@ import (
 )
 
 func List(w http.ResponseWriter, r *http.Request) {
-	store := common.Kforum.Store
+	site := common.SiteOf(r)
+	store := site.Forum.Store
 	q := r.FormValue("q")
 	qt := r.FormValue("qt")
 
@@ -24,34 +26,53 @@ func List(w http.ResponseWriter, r *http.Request) {
 		IsAdmin    bool
 		Query      string
 		QueryText  string
+		Error      string
 		Blocked    map[string]bool
 		IsBlocked  bool
-	}{Forum: *common.Kforum}
+		Pages      int
+		CurPage    int
+		PageQuery  string
+	}{Forum: *site.Forum, QueryText: qt}
 
 	if q == "" && qt == "" {
 		server.Render(w, server.TmplPosts, model)
 		return
 	}
 
-	query := server.Parse8Bytes(q)
-	user := common.Kforum.GetUser(r)
-	isAdmin := user.CanModerate()
-	maxTopics := 50
-
-	if !isAdmin && q != "" {
-		if query != user.ID {
-			// non admin can only query himself
+	query := &server.Query{}
+	if qt != "" {
+		var err error
+		if query, err = server.ParseQuery(qt); err != nil {
+			model.Error = err.Error()
 			server.Render(w, server.TmplPosts, model)
 			return
 		}
 	}
+	if q != "" {
+		query.Term = server.Parse8Bytes(q)
+	}
+
+	user := site.Forum.GetUser(r)
+	isAdmin := user.CanModerate()
 
-	if count := r.FormValue("count"); isAdmin && count != "" {
-		maxTopics, _ = strconv.Atoi(count)
+	if !isAdmin && query.ModOnly(user) {
+		// non admin can only query himself
+		model.Error = "only moderators can search others, IPs or deleted posts"
+		server.Render(w, server.TmplPosts, model)
+		return
 	}
 
-	posts, total := store.GetPostsBy(query, qt, maxTopics, int64(common.Kforum.SearchTimeout)*1e6)
-	isBlocked := store.IsBlocked(query)
+	count, _ := strconv.Atoi(r.FormValue("count"))
+	if count < 1 || (count > 100 && !isAdmin) {
+		count = 50
+	}
+	p, _ := strconv.Atoi(r.FormValue("p"))
+	if p < 1 {
+		p = 1
+	}
+
+	posts, total := store.Search(query, (p-1)*count, count, int64(site.Forum.SearchTimeout)*1e6)
+	isBlocked := store.IsBlocked(query.Term)
 
 	for i := range posts {
 		posts[i].T_SetStatus(server.POST_T_ISREF)
@@ -59,28 +80,43 @@ func List(w http.ResponseWriter, r *http.Request) {
 
 	model.Topic = server.Topic{
 		Posts:     posts,
-		Subject:   fmt.Sprintf("%s: %x", q, query),
+		Subject:   fmt.Sprintf("%s: %x", q, query.Term),
 		T_IsAdmin: isAdmin,
 	}
 	model.TotalCount = total
 	model.IsAdmin = isAdmin
 	model.IsBlocked = isBlocked
 	model.Query = q
-	model.QueryText = qt
+	model.Pages, model.CurPage = intdivceil(total, count), p
+	model.PageQuery = url.Values{"q": {q}, "qt": {qt}, "count": {strconv.Itoa(count)}}.Encode()
 
 	server.Render(w, server.TmplPosts, model)
 }
 
+// url: /rss.xml?board={board}
 func RSS(w http.ResponseWriter, r *http.Request) {
+	site := common.SiteOf(r)
+	board := r.FormValue("board")
+	forum, ok := boardForum(site, board)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	link := site.Forum.URL
+	if board != "" {
+		link += "/b/" + board
+	}
+
 	xml := []string{
 		`<?xml version="1.0" encoding="UTF-8"?>`,
 		`<rss version="2.0"><channel>`,
-		`<title>`, common.Kforum.Title, `</title>`,
+		`<title>`, forum.Title, `</title>`,
 		`<pubDate>`, time.Now().Format(time.RFC1123Z), `</pubDate>`,
-		`<link>`, common.Kforum.URL, `</link>`,
+		`<link>`, link, `</link>`,
 	}
 
-	topics := common.Kforum.GetTopics(0, 20, common.TopicFilter1, server.DefaultTopicMapper)
+	topics := site.Forum.GetTopics(0, 20, server.BoardFilter(board), server.DefaultTopicMapper)
 	for _, g := range topics {
 		var message string
 		if len(g.Posts) > 0 {
@@ -91,7 +127,7 @@ func RSS(w http.ResponseWriter, r *http.Request) {
 			`<item>`,
 			`<title>`, g.Subject, `</title>`,
 			`<pubDate>`, time.Unix(int64(g.CreatedAt), 0).Format(time.RFC1123Z), `</pubDate>`,
-			`<link>`, common.Kforum.URL, "/t/", strconv.FormatUint(uint64(g.ID), 10), `</link>`,
+			`<link>`, site.Forum.URL, "/t/", strconv.FormatUint(uint64(g.ID), 10), `</link>`,
 			`<description>`, `<![CDATA[`, message, `]]>`, `</description>`,
 			`</item>`,
 		)
@@ -23,7 +23,8 @@ import (
 var rxImageExts = regexp.MustCompile(`(?i)(\.png|\.jpg|\.jpeg|\.gif|\.svg)$`)
 
 func PostAPI(w http.ResponseWriter, r *http.Request) {
-	r.Body = http.MaxBytesReader(w, r.Body, int64(common.Kforum.MaxImageSize)*1024*1024)
+	site := common.SiteOf(r)
+	r.Body = http.MaxBytesReader(w, r.Body, int64(site.Forum.MaxImageSize)*1024*1024)
 
 	if r.Method != "POST" {
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -33,63 +34,78 @@ func PostAPI(w http.ResponseWriter, r *http.Request) {
 	badRequest := func() { writeSimpleJSON(w, "success", false, "error", "bad-request") }
 	internalError := func() { writeSimpleJSON(w, "success", false, "error", "internal-error") }
 
+	if site.Forum.IsReadOnly() {
+		writeSimpleJSON(w, "success", false, "error", "read-only")
+		return
+	}
+
 	var topic server.Topic
 
 	topicID, _ := strconv.Atoi(strings.TrimSpace(r.FormValue("topic")))
 	if topicID > 0 {
-		if topic = common.Kforum.Store.GetTopic(uint32(topicID), server.DefaultTopicMapper); topic.ID == 0 {
-			common.Kforum.Notice("invalid topic ID: %d\n", topicID)
+		if topic = site.Forum.Store.GetTopic(uint32(topicID), server.DefaultTopicMapper); topic.ID == 0 {
+			site.Forum.Notice("invalid topic ID: %d\n", topicID)
 			badRequest()
 			return
 		}
 	}
 
-	ipAddr, user := getIPAddress(r), common.Kforum.GetUser(r)
+	board := r.FormValue("board")
+	if topic.ID > 0 {
+		board = topic.Board
+	}
+	config, ok := site.Forum.Board(board)
+	if !ok {
+		badRequest()
+		return
+	}
+
+	ipAddr, user := getIPAddress(r), site.Forum.GetUser(r)
 
 	if !user.Can(server.PERM_ADMIN) {
-		if common.Kforum.Store.IsBlocked(ipAddr) {
-			common.Kforum.Notice("blocked a post from IP: %v", ipAddr)
+		if site.Forum.Store.IsBlocked(ipAddr) {
+			site.Forum.Notice("blocked a post from IP: %v", ipAddr)
 			badRequest()
 			return
 		}
-		if common.Kforum.Store.IsBlocked(user.ID) {
-			common.Kforum.Notice("blocked a post from user %v", user.ID)
+		if site.Forum.Store.IsBlocked(user.ID) {
+			site.Forum.Notice("blocked a post from user %v", user.ID)
 			badRequest()
 			return
 		}
-		if !user.CanModerate() && !throtNewPost(ipAddr, user.ID) {
+		if !user.CanModerate() && !throtNewPost(site, ipAddr, user.ID, config.Cooldown) {
 			badRequest()
 			return
 		}
 	}
 
-	if !strings.HasPrefix(r.Referer(), common.Kforum.URL) && common.Kprod {
+	if !strings.HasPrefix(r.Referer(), site.Forum.URL) && site.Prod {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
 	if !user.IsValid() {
-		if common.Kforum.NoMoreNewUsers && !topic.FreeReply {
+		if site.Forum.NoMoreNewUsers && !topic.FreeReply {
 			writeSimpleJSON(w, "success", false, "error", "no-more-new-users")
 			return
 		}
-		copy(user.ID[2:], common.Kforum.Rand.Fetch(6))
+		copy(user.ID[2:], site.Forum.Rand.Fetch(6))
 		user.T = time.Now().Unix()
 		if topic.ID == 0 {
-			user.N = uint32(common.Kforum.Rand.Intn(10) + 10)
+			user.N = uint32(site.Forum.Rand.Intn(10) + 10)
 		} else {
-			user.N = uint32(common.Kforum.Rand.Intn(5) + 5)
+			user.N = uint32(site.Forum.Rand.Intn(5) + 5)
 		}
 	}
 
 	// if user didn't pass the dice test, we will challenge him/her
-	if !common.Kforum.NoRecaptcha && !user.Can(server.PERM_NO_ROLL) && !user.PassRoll() {
-		_testCount, _ := common.KbadUsers.Get(user.ID)
+	if !site.Forum.NoRecaptcha && !user.Can(server.PERM_NO_ROLL) && !user.PassRoll() {
+		_testCount, _ := site.BadUsers.Get(user.ID)
 		testCount, _ := _testCount.(int)
 		if testCount++; testCount > 10 {
-			common.KbadUsers.Remove(user.ID)
-			common.Kforum.Block(user.ID)
-			common.Kforum.Block(ipAddr)
+			site.BadUsers.Remove(user.ID)
+			site.Forum.Block(user.ID)
+			site.Forum.Block(ipAddr)
 			badRequest()
 			return
 		}
@@ -97,16 +113,16 @@ func PostAPI(w http.ResponseWriter, r *http.Request) {
 		recaptcha := strings.TrimSpace(r.FormValue("token"))
 		if recaptcha == "" {
 			writeSimpleJSON(w, "success", false, "error", "recaptcha-needed")
-			common.KbadUsers.Add(user.ID, testCount)
+			site.BadUsers.Add(user.ID, testCount)
 			return
 		}
 
 		resp, err := (&http.Client{Timeout: time.Second * 5}).PostForm("https://www.recaptcha.net/recaptcha/api/siteverify", url.Values{
-			"secret":   []string{common.Kforum.RecaptchaSecret},
+			"secret":   []string{site.Forum.RecaptchaSecret},
 			"response": []string{recaptcha},
 		})
 		if err != nil {
-			common.Kforum.Error("recaptcha error: %v", err)
+			site.Forum.Error("recaptcha error: %v", err)
 			internalError()
 			return
 		}
@@ -118,13 +134,13 @@ func PostAPI(w http.ResponseWriter, r *http.Request) {
 		json.Unmarshal(buf, &recaptchaResult)
 
 		if r, _ := recaptchaResult["success"].(bool); !r {
-			common.Kforum.Error("recaptcha failed: %v", string(buf))
-			common.KbadUsers.Add(user.ID, testCount)
+			site.Forum.Error("recaptcha failed: %v", string(buf))
+			site.BadUsers.Add(user.ID, testCount)
 			writeSimpleJSON(w, "success", false, "error", "recaptcha-failed")
 			return
 		}
 	}
-	common.KbadUsers.Remove(user.ID)
+	site.BadUsers.Remove(user.ID)
 
 	subject := strings.Replace(r.FormValue("subject"), "<", "&lt;", -1)
 	msg := r.FormValue("message")
@@ -142,26 +158,64 @@ func PostAPI(w http.ResponseWriter, r *http.Request) {
 		msg = reMessage.ReplaceAllString(msg, "```")
 	}
 
-	if modCode(common.Kforum, user, subject, msg) {
+	if strings.HasPrefix(subject, "!!edit=") {
+		longID, _ := strconv.ParseUint(subject[7:], 10, 64)
+
+		// the edited post follows the limits of its own board
+		topicID, postID := server.SplitID(site.Forum.Store.Redirect(longID))
+		edited := site.Forum.Store.GetTopic(topicID, server.DefaultTopicMapper)
+		config, ok := site.Forum.Board(edited.Board)
+		if edited.ID == 0 || postID == 0 || int(postID) > len(edited.Posts) || !ok {
+			writeSimpleJSON(w, "success", false, "error", "edit-not-found")
+			return
+		}
+		if len(msg) > config.MaxMessageLen {
+			msg = msg[:config.MaxMessageLen]
+		}
+		if len(msg) < config.MinMessageLen && edited.Posts[postID-1].Image == nil {
+			writeSimpleJSON(w, "success", false, "error", "message-too-short")
+			return
+		}
+		switch err := site.Forum.EditPost(user, longID, msg, site.Forum.EditWindow); err {
+		case nil:
+		case server.ErrEditDenied:
+			writeSimpleJSON(w, "success", false, "error", "edit-denied")
+			return
+		case server.ErrEditExpired:
+			writeSimpleJSON(w, "success", false, "error", "edit-expired")
+			return
+		case server.ErrEditLocked:
+			writeSimpleJSON(w, "success", false, "error", "topic-locked")
+			return
+		default:
+			site.Forum.Error("failed to edit %d: %v", longID, err)
+			writeSimpleJSON(w, "success", false, "error", "edit-failed")
+			return
+		}
+		writeSimpleJSON(w, "success", true, "longid", longID)
+		return
+	}
+
+	if modCode(site, user, subject, msg) {
 		_, username := server.Format8Bytes(user.ID)
 		ipstr, _ := server.Format8Bytes(ipAddr)
-		common.Kforum.Notice("mod %s from %s has performed: %s", username, ipstr, msg)
+		site.Forum.Notice("mod %s from %s has performed: %s", username, ipstr, msg)
 		writeSimpleJSON(w, "success", true, "mod-operation", msg)
 		return
 	}
 
 	// simple mechanism to prevent double post only
 	uuid := server.DecodeUUID(r.FormValue("uuid"))
-	if _, existed := common.Kuuids.Get(uuid); existed {
+	if _, existed := site.UUIDs.Get(uuid); existed {
 		badRequest()
 		return
 	}
-	common.Kuuids.Add(uuid, true)
+	site.UUIDs.Add(uuid, true)
 
 	if topic.ID == 0 {
-		if tmp := []rune(subject); len(tmp) > common.Kforum.MaxSubjectLen {
-			tmp[common.Kforum.MaxSubjectLen-1], tmp[common.Kforum.MaxSubjectLen-2], tmp[common.Kforum.MaxSubjectLen-3] = '.', '.', '.'
-			subject = string(tmp[:common.Kforum.MaxSubjectLen])
+		if tmp := []rune(subject); len(tmp) > config.MaxSubjectLen {
+			tmp[config.MaxSubjectLen-1], tmp[config.MaxSubjectLen-2], tmp[config.MaxSubjectLen-3] = '.', '.', '.'
+			subject = string(tmp[:config.MaxSubjectLen])
 		}
 	}
 
@@ -175,82 +229,129 @@ func PostAPI(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if image != nil && imageInfo != nil && common.Kforum.NoImageUpload {
+	if image != nil && imageInfo != nil && config.NoImageUpload {
 		writeSimpleJSON(w, "success", false, "error", "image-upload-disabled")
 		return
 	}
 
-	if len(msg) > common.Kforum.MaxMessageLen {
+	if len(msg) > config.MaxMessageLen {
 		// hard trunc
-		msg = msg[:common.Kforum.MaxMessageLen]
+		msg = msg[:config.MaxMessageLen]
 	}
 
-	if len(msg) < common.Kforum.MinMessageLen && image == nil {
+	if len(msg) < config.MinMessageLen && image == nil {
 		writeSimpleJSON(w, "success", false, "error", "message-too-short")
 		return
 	}
 
-	if topic.ID > 0 && topic.Locked {
+	if topic.ID > 0 && topic.Locked && topic.ContinuedBy == 0 {
 		writeSimpleJSON(w, "success", false, "error", "topic-locked")
 		return
 	}
 
 	if !nocookie {
-		common.Kforum.SetUser(w, user)
+		site.Forum.SetUser(w, user)
 	}
 
 	var aImage *server.Image
 	if image != nil && imageInfo != nil {
 		aImage = &server.Image{}
 
-		ext, hash := strings.ToLower(filepath.Ext(imageInfo.Filename)), sha1.Sum([]byte(imageInfo.Filename))
+		ext := strings.ToLower(filepath.Ext(imageInfo.Filename))
 		if !rxImageExts.MatchString(ext) {
 			writeSimpleJSON(w, "success", false, "error", "image-invalid-format")
 			return
 		}
 
-		t := time.Now().Format("2006-Jan/02-15h")
-		aImage.Name = sanitizeFilename(imageInfo.Filename)
-		aImage.Path = fmt.Sprintf("%s/%s_%x%s", t, aImage.Name, hash[:4], ext)
-		os.MkdirAll(common.DATA_IMAGES+t, 0755)
+		// write into a temp file first, then rename it to the SHA1 of its contents, so the same image is stored once
+		of, err := ioutil.TempFile(site.Dir+common.DATA_IMAGES, "upload")
+		if err != nil {
+			writeSimpleJSON(w, "success", false, "error", "image-disk-error")
+			site.Forum.Error("copy image to dest: %v", err)
+			return
+		}
+		defer os.Remove(of.Name())
 
-		of, err := os.Create(common.DATA_IMAGES + aImage.Path)
+		hash := sha1.New()
+		nw, err := io.Copy(io.MultiWriter(of, hash), image)
+		of.Close()
+		os.Chmod(of.Name(), 0644)
 		if err != nil {
 			writeSimpleJSON(w, "success", false, "error", "image-disk-error")
-			common.Kforum.Error("copy image to dest: %v", err)
+			site.Forum.Error("copy image to dest: %v", err)
+			return
+		}
+
+		var rewritten []byte
+		aImage.X, aImage.Y, rewritten, err = server.CheckImage(of.Name(), ext, site.Forum.MaxImagePixels*1000*1000)
+		switch err {
+		case nil:
+		case server.ErrImageFormat:
+			writeSimpleJSON(w, "success", false, "error", "image-invalid-format")
+			return
+		case server.ErrImageTooLarge:
+			writeSimpleJSON(w, "success", false, "error", "image-too-large")
+			return
+		default:
+			writeSimpleJSON(w, "success", false, "error", "image-disk-error")
+			site.Forum.Error("check image: %v", err)
 			return
 		}
 
-		nw, _ := io.Copy(of, image)
+		if rewritten != nil {
+			hash.Reset()
+			hash.Write(rewritten)
+			nw = int64(len(rewritten))
+		}
+
+		aImage.Name = sanitizeFilename(imageInfo.Filename)
+		aImage.Path = fmt.Sprintf("%x%s", hash.Sum(nil), ext)
 		aImage.Size = uint32(nw)
-		common.Kiq.Push(common.DATA_IMAGES + aImage.Path)
-		of.Close()
+
+		// the same image may be removed by others before the post refers to it, hold it till then
+		file := site.ImageFile(aImage.Path)
+		release, err := site.Forum.Store.HoldImage(aImage.Path, func() error {
+			if _, err := os.Stat(file); !os.IsNotExist(err) {
+				return err
+			}
+			os.MkdirAll(filepath.Dir(file), 0755)
+			return os.Rename(of.Name(), file)
+		})
+		if err != nil {
+			writeSimpleJSON(w, "success", false, "error", "image-disk-error")
+			site.Forum.Error("copy image to dest: %v", err)
+			return
+		}
+		defer release()
+		site.Images.Push(file)
 	}
 
 	var postLongID uint64
 	if topic.ID == 0 {
-		postLongID, err = common.Kforum.Store.NewTopic(subject, msg, aImage, user.ID, ipAddr, sage)
+		postLongID, err = site.Forum.Store.NewTopicIn(board, subject, msg, aImage, user.ID, ipAddr, sage)
 		if err != nil {
-			common.Kforum.Error("failed to create new topic: %v", err)
+			site.Forum.Error("failed to create new topic: %v", err)
 			internalError()
 			return
 		}
 		if nsfw {
-			common.Kforum.Store.FlagPost(user, postLongID, server.OP_NSFW, func(p *server.Post) {
+			site.Forum.Store.FlagPost(user, postLongID, server.OP_NSFW, func(p *server.Post) {
 				p.T_SetStatus(server.POST_T_ISNSFW)
 			})
 		}
-		if common.Kforum.Rand.Intn(64) == 0 || (!common.Kprod && common.Kforum.Rand.Intn(3) == 0) {
-			go func() {
-				start := time.Now()
-				common.Kforum.ArchiveJob()
-				common.Kforum.Notice("archive threads in %.2fs", time.Since(start).Seconds())
-			}()
-		}
 	} else {
-		postLongID, err = common.Kforum.Store.NewPost(topic.ID, msg, aImage, user.ID, ipAddr, sage)
+		limit := 0
+		if site.Forum.AutoContinue {
+			limit = site.Forum.BumpLimit
+		}
+		// replies to a full topic go to its continuation
+		postLongID, err = site.Forum.Store.ContinuePost(topic.ID, limit, msg, aImage, user.ID, ipAddr, sage)
+		if err == server.ErrTopicLocked {
+			writeSimpleJSON(w, "success", false, "error", "topic-locked")
+			return
+		}
 		if err != nil {
-			common.Kforum.Error("failed to create new post to %d: %v", topic.ID, err)
+			site.Forum.Error("failed to create new post to %d: %v", topic.ID, err)
 			internalError()
 			return
 		}
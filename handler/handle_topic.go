@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/coyove/fofou/common"
 	"github.com/coyove/fofou/server"
@@ -13,42 +14,50 @@ import (
 
 type newPostInfo struct {
 	TopicID   int
+	BoardName string
 	PostToken string
 	IsAdmin   bool
 }
 
 // url: /t/{tid}
 func Topic(w http.ResponseWriter, r *http.Request) {
+	site := common.SiteOf(r)
 	topicID, _ := strconv.Atoi(r.URL.Path[len("/t/"):])
-	topic := common.Kforum.Store.GetTopic(uint32(topicID), server.DefaultTopicMapper)
+	topic := site.Forum.Store.GetTopic(uint32(topicID), server.DefaultTopicMapper)
 	if topic.ID == 0 {
 		var err error
-		if i, ok := common.Karchive.Get(topicID); ok {
+		if i, ok := site.Archive.Get(topicID); ok {
 			topic = i.(server.Topic)
 			goto NEXT
 		}
 
-		topic, err = common.Kforum.LoadArchivedTopic(uint32(topicID), common.Kforum.Salt)
+		// merged into another topic
+		if longID := server.LongID(uint32(topicID), 1); site.Forum.Redirect(longID) != longID {
+			http.Redirect(w, r, fmt.Sprintf("/p/%d", site.Forum.Redirect(longID)), 302)
+			return
+		}
+
+		topic, err = site.Forum.LoadArchivedTopic(uint32(topicID), site.Forum.Salt)
 		if err == nil {
 			topic.Archived = true
-			common.Karchive.Add(topicID, topic)
+			site.Archive.Add(topicID, topic)
 			goto NEXT
 		}
 
-		common.Kforum.Notice("can't find topic with id %d, referer: %q, err: %v", topicID, r.Referer(), err)
+		site.Forum.Notice("can't find topic with id %d, referer: %q, err: %v", topicID, r.Referer(), err)
 		http.Redirect(w, r, "/", 302)
 		return
 	}
 
 NEXT:
-	user := common.Kforum.GetUser(r)
+	user := site.Forum.GetUser(r)
 	isAdmin := user.CanModerate()
 	if len(topic.Posts) == 0 {
 		http.Redirect(w, r, "/", 302)
 		return
 	}
 
-	pages := intdivceil(len(topic.Posts), common.Kforum.PostsPerPage)
+	pages := intdivceil(len(topic.Posts), site.Forum.PostsPerPage)
 	p, _ := strconv.Atoi(r.FormValue("p"))
 	if p < 1 {
 		p = 1
@@ -59,7 +68,7 @@ NEXT:
 
 	topic.T_TotalPosts = uint16(len(topic.Posts) - 1)
 	topic.T_IsAdmin = isAdmin
-	posts := topic.Posts[(p-1)*common.Kforum.PostsPerPage : intmin(p*common.Kforum.PostsPerPage, len(topic.Posts))]
+	posts := topic.Posts[(p-1)*site.Forum.PostsPerPage : intmin(p*site.Forum.PostsPerPage, len(topic.Posts))]
 	if p == 1 {
 		tmp := make([]server.Post, len(posts))
 		copy(tmp, posts)
@@ -73,6 +82,7 @@ NEXT:
 	topic.Posts[0].T_SetStatus(server.POST_T_ISFIRST)
 	topic.Reparent(user.ID)
 
+	forum, _ := boardForum(site, topic.Board)
 	model := struct {
 		server.Forum
 		server.Topic
@@ -80,87 +90,162 @@ NEXT:
 		Pages   int
 		CurPage int
 	}{
-		Forum:   *common.Kforum,
+		Forum:   forum,
 		Topic:   topic,
 		Pages:   pages,
 		CurPage: p,
 	}
 	model.TopicID = topicID
-	_, model.PostToken = common.Kforum.UUID()
+	model.BoardName = topic.Board
+	_, model.PostToken = site.Forum.UUID()
 	model.IsAdmin = isAdmin
 	server.Render(w, server.TmplTopic, model)
 }
 
+// url: /, /b/{board}, /tagged?tag={tag}
 func Topics(w http.ResponseWriter, r *http.Request) {
-	showSpecial := strings.HasPrefix(r.URL.Path, "/tagged")
+	site := common.SiteOf(r)
+	var board, tag string
+	if r.URL.Path == "/tagged" {
+		if tag = server.NormalizeTag(r.FormValue("tag")); tag == "" {
+			http.Redirect(w, r, "/b/"+server.TaggedBoard, 301)
+			return
+		}
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/b/") {
+		board = strings.TrimSuffix(r.URL.Path[len("/b/"):], "/")
+	}
+	forum, ok := boardForum(site, board)
+	if !ok || (board == "" && tag == "" && r.URL.Path != "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	filter, count := server.BoardFilter(board), 0
+	if tag != "" {
+		// tags are across all boards
+		count = site.Forum.TaggedNum(tag)
+		forum.Title = "#" + tag + " - " + forum.Title
+	} else {
+		count = site.Forum.CountTopics(filter)
+	}
+
 	p, _ := strconv.Atoi(r.FormValue("p"))
 	if p < 1 {
 		p = 1
 	}
 
-	user := common.Kforum.GetUser(r)
+	user := site.Forum.GetUser(r)
 	isAdmin := user.CanModerate()
-	filter := common.TopicFilter1
-	if showSpecial {
-		filter = common.TopicFilter2
-	}
-	topics := common.Kforum.GetTopics((p-1)*common.Kforum.TopicsPerPage, common.Kforum.TopicsPerPage,
-		filter,
-		func(topic *server.Topic) server.Topic {
-			t := *topic
-			t.T_TotalPosts = uint16(len(t.Posts) - 1)
-			t.T_IsAdmin = isAdmin
-			t.T_IsExpand = true
-			if len(t.Posts) > 5 {
-				tmp := make([]server.Post, 5)
-				tmp[0] = t.Posts[0]
-				copy(tmp[1:], t.Posts[len(t.Posts)-4:])
-				t.Posts = tmp
-			} else {
-				tmp := make([]server.Post, len(t.Posts))
-				copy(tmp, t.Posts)
-				t.Posts = tmp
-			}
-			t.Posts[0].T_SetStatus(server.POST_T_ISFIRST)
-			t.Reparent(user.ID)
-			return t
-		})
+	mapper := func(topic *server.Topic) server.Topic {
+		t := *topic
+		t.T_TotalPosts = uint16(len(t.Posts) - 1)
+		t.T_IsAdmin = isAdmin
+		t.T_IsExpand = true
+		if len(t.Posts) > 5 {
+			tmp := make([]server.Post, 5)
+			tmp[0] = t.Posts[0]
+			copy(tmp[1:], t.Posts[len(t.Posts)-4:])
+			t.Posts = tmp
+		} else {
+			tmp := make([]server.Post, len(t.Posts))
+			copy(tmp, t.Posts)
+			t.Posts = tmp
+		}
+		t.Posts[0].T_SetStatus(server.POST_T_ISFIRST)
+		t.Reparent(user.ID)
+		return t
+	}
+
+	var topics []server.Topic
+	if tag != "" {
+		topics = site.Forum.GetTaggedTopics(tag, (p-1)*site.Forum.TopicsPerPage, site.Forum.TopicsPerPage, mapper)
+	} else {
+		topics = site.Forum.GetTopics((p-1)*site.Forum.TopicsPerPage, site.Forum.TopicsPerPage, filter, mapper)
+	}
 
 	model := struct {
 		server.Forum
 		newPostInfo
 		Pages   int
 		CurPage int
+		Tag     string
 		Topics  []server.Topic
 	}{
-		Forum:   *common.Kforum,
+		Forum:   forum,
 		Topics:  topics,
 		CurPage: p,
-		Pages:   intdivceil(common.Kforum.LiveTopicsNum, common.Kforum.TopicsPerPage),
+		Tag:     tag,
+		Pages:   intdivceil(count, site.Forum.TopicsPerPage),
 	}
 
-	_, model.PostToken = common.Kforum.UUID()
+	model.BoardName = board
+	_, model.PostToken = site.Forum.UUID()
 	model.IsAdmin = isAdmin
 	server.Render(w, server.TmplForum, model)
 }
 
+// url: /archive?m={2006-01}&p={page}
+func Archive(w http.ResponseWriter, r *http.Request) {
+	site := common.SiteOf(r)
+	month := r.FormValue("m")
+	if _, err := time.Parse("2006-01", month); err != nil {
+		month = ""
+	}
+	p, _ := strconv.Atoi(r.FormValue("p"))
+	if p < 1 {
+		p = 1
+	}
+
+	count := site.Forum.TopicsPerPage * 4
+	topics, total := site.Forum.ArchivedTopics(month, (p-1)*count, count)
+
+	model := struct {
+		server.Forum
+		Months     []server.ArchiveMonth
+		Month      string
+		Topics     []server.ArchivedTopic
+		TotalCount int
+		Pages      int
+		CurPage    int
+	}{
+		Forum:      *site.Forum,
+		Months:     site.Forum.ArchiveMonths(),
+		Month:      month,
+		Topics:     topics,
+		TotalCount: total,
+		Pages:      intdivceil(total, count),
+		CurPage:    p,
+	}
+	server.Render(w, server.TmplArchive, model)
+}
+
 func Post(w http.ResponseWriter, r *http.Request) {
+	site := common.SiteOf(r)
 	longID, _ := strconv.ParseInt(r.URL.Path[len("/p/"):], 10, 64)
+	if to := site.Forum.Redirect(uint64(longID)); to != uint64(longID) {
+		u := *r.URL
+		u.Path = fmt.Sprintf("/p/%d", to)
+		http.Redirect(w, r, u.String(), 302)
+		return
+	}
+
 	topicID, postID := server.SplitID(uint64(longID))
-	user := common.Kforum.GetUser(r)
+	user := site.Forum.GetUser(r)
 
 	raw := r.FormValue("raw")
 
 	if raw == "" {
-		p := intdivceil(int(postID), common.Kforum.PostsPerPage)
+		p := intdivceil(int(postID), site.Forum.PostsPerPage)
 		http.Redirect(w, r, fmt.Sprintf("/t/%d?p=%d#post-%d", topicID, p, longID), 302)
 		return
 	}
 
-	topic := common.Kforum.Store.GetTopic(topicID, server.DefaultTopicMapper)
+	topic := site.Forum.Store.GetTopic(topicID, server.DefaultTopicMapper)
 	if topic.ID == 0 {
 		var err error
-		topic, err = common.Kforum.LoadArchivedTopic(uint32(topicID), common.Kforum.Salt)
+		topic, err = site.Forum.LoadArchivedTopic(uint32(topicID), site.Forum.Salt)
 		if err == nil {
 			topic.Archived = true
 			goto NEXT
@@ -187,12 +272,31 @@ NEXT:
 		return
 	}
 
+	if raw == "revisions" {
+		if !user.CanModerate() {
+			w.WriteHeader(403)
+			return
+		}
+
+		p := &topic.Posts[0]
+		w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+		for i, r := range p.Revisions {
+			fmt.Fprintf(w, "#%d revision %d, %s:\n%s\n\n", longID, i+1, r.Date(), r.Message)
+		}
+		if p.EditedAt > 0 {
+			fmt.Fprintf(w, "#%d current, %s:\n%s\n", longID, p.EditDate(), p.Message)
+		} else {
+			fmt.Fprintf(w, "#%d has never been edited\n", longID)
+		}
+		return
+	}
+
 	model := struct {
 		server.Forum
 		server.Topic
 		TopicID int
 	}{
-		Forum:   *common.Kforum,
+		Forum:   *site.Forum,
 		Topic:   topic,
 		TopicID: int(topicID),
 	}
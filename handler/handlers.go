@@ -2,12 +2,14 @@
 package handler
 
 import (
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -27,19 +29,25 @@ func Static(w http.ResponseWriter, r *http.Request) {
 }
 
 func Image(w http.ResponseWriter, r *http.Request) {
+	site := common.SiteOf(r)
 	path := r.URL.Path[len("/i/"):]
 	path = strings.Replace(path, "..", "", -1)
-	file := filepath.Join(common.DATA_IMAGES, path)
+	file := site.ImageFile(path)
 
 	if rxImageExts.MatchString(file) {
-		if r.FormValue("thumb") == "1" && !strings.HasSuffix(file, ".svg") {
-			path := file + ".thumb.jpg"
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if strings.HasSuffix(strings.ToLower(file), ".svg") {
+			// uploads are sanitized, but older ones are not
+			w.Header().Set("Content-Type", "image/svg+xml")
+			w.Header().Set("Content-Security-Policy", server.SVGCSP)
+		} else if size, _ := strconv.Atoi(r.FormValue("thumb")); size == server.ThumbSmall || size == server.ThumbMedium {
+			path := server.ThumbFile(file, size)
 			if fi, err := os.Stat(path); err == nil {
 				common.Ktraffic.Recv(fi.Size())
 				http.ServeFile(w, r, path)
 				return
 			}
-			common.Kiq.Push(file)
+			site.Images.Push(file)
 		}
 
 		fi, _ := os.Stat(file)
@@ -65,14 +73,14 @@ func Image(w http.ResponseWriter, r *http.Request) {
 		Up    string
 		Path  string
 	}{
-		Forum: *common.Kforum,
+		Forum: *site.Forum,
 		Path:  path,
 		Up:    filepath.Dir(path),
 	}
 
 	p.Files = make([]_file, 0, len(files))
 	for _, file := range files {
-		if strings.HasSuffix(file.Name(), ".thumb.jpg") {
+		if strings.HasSuffix(file.Name(), ".thumb.jpg") || strings.HasSuffix(file.Name(), ".thumb2.jpg") {
 			continue
 		}
 
@@ -102,8 +110,10 @@ func Image(w http.ResponseWriter, r *http.Request) {
 }
 
 func Help(w http.ResponseWriter, r *http.Request) {
-	path := "data/main.txt.snapshot"
+	site := common.SiteOf(r)
+	path := site.Dir + common.DATA_SNAPSHOT
 	if r.RequestURI == "/data.bin" {
+		w.Header().Add("Content-Type", "application/octet-stream")
 		http.ServeFile(w, r, path)
 		return
 	}
@@ -113,7 +123,7 @@ func Help(w http.ResponseWriter, r *http.Request) {
 		DataBinSize uint64
 		DataBinTime string
 	}{}
-	p.Forum = *common.Kforum
+	p.Forum = *site.Forum
 	if fi != nil {
 		p.DataBinSize = uint64(fi.Size())
 		p.DataBinTime = fi.ModTime().Format(time.RFC1123)
@@ -121,13 +131,41 @@ func Help(w http.ResponseWriter, r *http.Request) {
 	server.Render(w, server.TmplHelp, p)
 }
 
+// url: /replicate, streams main.txt to replicas, see Store.Follow
+func Replicate(w http.ResponseWriter, r *http.Request) {
+	site := common.SiteOf(r)
+	if !site.Forum.IsReady() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if r.FormValue("token") != server.ReplicaToken(site.Password) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	offset, _ := strconv.ParseInt(r.FormValue("offset"), 10, 64)
+	err := site.Forum.ReadLog(offset, r.FormValue("digest"), time.Second*30, func(end int64, rd io.Reader) error {
+		w.Header().Add("Content-Type", "application/octet-stream")
+		w.Header().Add("X-Log-Size", strconv.FormatInt(end, 10))
+		_, err := io.Copy(w, rd)
+		return err
+	})
+
+	if err == server.ErrLogMismatch {
+		w.WriteHeader(http.StatusConflict)
+	} else if err != nil {
+		site.Forum.Error("failed to stream the store to %s: %v", r.RemoteAddr, err)
+	}
+}
+
 // url: /robots.txt
 func RobotsTxt(w http.ResponseWriter, r *http.Request) {
 	serveFileFromDir(w, r, "static", "robots.txt")
 }
 
 func Cookie(w http.ResponseWriter, r *http.Request) {
-	if m := r.FormValue("admin"); m == common.Kpassword {
+	site := common.SiteOf(r)
+	if m := r.FormValue("admin"); m == site.Password {
 		// admin requesting a cookie
 		u, parts := server.User{}, strings.Split(r.FormValue("makeid"), ",")
 		copy(u.ID[:], parts[0])
@@ -135,12 +173,12 @@ func Cookie(w http.ResponseWriter, r *http.Request) {
 		if len(parts) > 2 {
 			_, _, _, _, u.N, _, _, _, _, _ = atoi(parts[2])
 		}
-		common.Kforum.SetUser(w, u)
+		site.Forum.SetUser(w, u)
 		http.Redirect(w, r, "/", 302)
 		return
 	}
 	if m := r.FormValue("makeid"); m != "" {
-		if !common.Kforum.GetUser(r).Can(server.PERM_ADMIN) {
+		if !site.Forum.GetUser(r).Can(server.PERM_ADMIN) {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
@@ -151,7 +189,7 @@ func Cookie(w http.ResponseWriter, r *http.Request) {
 		if len(parts) > 2 {
 			_, _, _, _, u.N, _, _, _, _, _ = atoi(parts[2])
 		}
-		w.Write([]byte(common.Kforum.SetUser(nil, u)))
+		w.Write([]byte(site.Forum.SetUser(nil, u)))
 		return
 	}
 	if m := r.FormValue("uid"); m != "" {
@@ -175,7 +213,8 @@ func Cookie(w http.ResponseWriter, r *http.Request) {
 }
 
 func Mod(w http.ResponseWriter, r *http.Request) {
-	if !common.Kforum.GetUser(r).Can(server.PERM_ADMIN) {
+	site := common.SiteOf(r)
+	if !site.Forum.GetUser(r).Can(server.PERM_ADMIN) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -189,16 +228,22 @@ func Mod(w http.ResponseWriter, r *http.Request) {
 		Notices []*server.TimestampedMsg
 		Header  *http.Header
 		IP      string
-		IQLen   int
+		IQStats server.ImageQueueStats
+		Trash   []server.TrashedTopic
 		runtime.MemStats
 	}{
-		Forum:    *common.Kforum,
+		Forum:    *site.Forum,
 		MemStats: *m,
-		Errors:   common.Kforum.GetErrors(),
-		Notices:  common.Kforum.GetNotices(),
+		Errors:   site.Forum.GetErrors(),
+		Notices:  site.Forum.GetNotices(),
 		Header:   &r.Header,
-		IQLen:    common.Kiq.Len(),
+		IQStats:  site.Images.Stats(),
 	}
 	model.IP, _ = server.Format8Bytes(getIPAddress(r))
+	if trash, err := site.Forum.TrashedTopics(); err != nil {
+		site.Forum.Error("trash: %v", err)
+	} else {
+		model.Trash = trash
+	}
 	server.Render(w, server.TmplLogs, model)
 }
@@ -2,26 +2,28 @@ package handler
 
 import (
 	"bufio"
-	"os"
+	"encoding/json"
+	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/coyove/fofou/common"
 	"github.com/coyove/fofou/server"
 )
 
-func modCode(forum *server.Forum, u server.User, subject, msg string) bool {
+func modCode(site *common.Site, u server.User, subject, msg string) bool {
 	r := bufio.NewReader(strings.NewReader(msg))
 	opcode := false
 
 	if u.Can(server.PERM_APPEND_ANNOUNCE) {
 		if strings.HasPrefix(subject, "!!append=") {
 			vint, _ := strconv.ParseInt(subject[9:], 10, 64)
-			common.Kforum.AppendPost(uint64(vint), "\n"+msg)
+			site.Forum.AppendPost(uint64(vint), "\n"+msg)
 			return true
 		}
 		if strings.HasPrefix(subject, "!!announce") {
-			common.Kforum.ForumConfig.Announcement = msg
+			site.Forum.ForumConfig.Announcement = msg
 			opcode = true
 			goto UPDATE
 		}
@@ -52,148 +54,360 @@ func modCode(forum *server.Forum, u server.User, subject, msg string) bool {
 			}
 			switch v {
 			case "cookie":
-				common.Kforum.NoMoreNewUsers = !common.Kforum.NoMoreNewUsers
+				site.Forum.NoMoreNewUsers = !site.Forum.NoMoreNewUsers
 			case "image":
-				common.Kforum.NoImageUpload = !common.Kforum.NoImageUpload
+				site.Forum.NoImageUpload = !site.Forum.NoImageUpload
+			case "continue":
+				site.Forum.AutoContinue = !site.Forum.AutoContinue
 			case "recaptcha":
-				common.Kforum.NoRecaptcha = !common.Kforum.NoRecaptcha
+				site.Forum.NoRecaptcha = !site.Forum.NoRecaptcha
 			case "production":
-				common.Kprod = !common.Kprod
-				common.Kforum.Logger.UseStdout = !common.Kprod
+				site.Prod = !site.Prod
+				site.Forum.Logger.UseStdout = site.Prod
 			}
 			opcode = true
 		case "max-message-len":
 			if !u.Can(server.PERM_ADMIN) {
 				return true
 			}
-			common.Kforum.MaxMessageLen = int(vint)
+			site.Forum.MaxMessageLen = int(vint)
 			opcode = true
 		case "max-subject-len":
 			if !u.Can(server.PERM_ADMIN) {
 				return true
 			}
-			common.Kforum.MaxSubjectLen = int(vint)
+			site.Forum.MaxSubjectLen = int(vint)
 			opcode = true
 		case "search-timeout":
 			if !u.Can(server.PERM_ADMIN) {
 				return true
 			}
-			common.Kforum.SearchTimeout = int(vint)
+			site.Forum.SearchTimeout = int(vint)
+			opcode = true
+		case "edit-window":
+			if !u.Can(server.PERM_ADMIN) {
+				return true
+			}
+			if vint < -1 {
+				site.Forum.Error("invalid edit window: %s", v)
+				break
+			}
+			site.Forum.EditWindow = int(vint)
+			opcode = true
+		case "bump-limit":
+			if !u.Can(server.PERM_ADMIN) {
+				return true
+			}
+			site.Forum.BumpLimit = int(vint)
 			opcode = true
 		case "cooldown":
 			if !u.Can(server.PERM_ADMIN) {
 				return true
 			}
-			common.Kforum.Cooldown = int(vint)
+			site.Forum.Cooldown = int(vint)
 			opcode = true
 		case "max-image-size":
 			if !u.Can(server.PERM_ADMIN) {
 				return true
 			}
-			common.Kforum.MaxImageSize = int(vint)
+			site.Forum.MaxImageSize = int(vint)
+			opcode = true
+		case "thumbs-backfill":
+			if !u.Can(server.PERM_ADMIN) {
+				return true
+			}
+			go func() {
+				start := time.Now()
+				n, err := site.Images.Backfill(site.Dir + common.DATA_IMAGES)
+				if err != nil {
+					site.Forum.Error("failed to backfill thumbnails: %v", err)
+					return
+				}
+				site.Forum.Notice("queue %d images without thumbnails in %.2fs", n, time.Since(start).Seconds())
+			}()
+			opcode = true
+		case "thumbs-retry":
+			if !u.Can(server.PERM_ADMIN) {
+				return true
+			}
+			site.Forum.Notice("retry %d dead thumbnails", site.Images.RetryDead())
+			opcode = true
+		case "max-image-pixels":
+			if !u.Can(server.PERM_ADMIN) {
+				return true
+			}
+			site.Forum.MaxImagePixels = int(vint)
 			opcode = true
 		case "nsfw":
-			res := common.Kforum.Store.FlagPost(u, uint64(vint), server.OP_NSFW, func(p *server.Post) {
+			res := site.Forum.Store.FlagPost(u, uint64(vint), server.OP_NSFW, func(p *server.Post) {
 				p.T_InvertStatus(server.POST_T_ISNSFW)
 			})
 			opcode = true
 			if res != nil {
-				common.Kforum.Error("%v", res)
+				site.Forum.Error("%v", res)
 				break
 			}
 		case "delete", "delete-image":
-			res := common.Kforum.Store.DeletePost(u, uint64(vint), op == "delete-image", func(img *server.Image) {
-				if img != nil {
-					os.Remove(common.DATA_IMAGES + img.Path)
-					os.Remove(common.DATA_IMAGES + img.Path + ".thumb.jpg")
-				}
-			})
+			res := site.Forum.Store.DeletePost(u, uint64(vint), op == "delete-image", site.RemoveImage)
 			opcode = true
 			if res != nil {
-				common.Kforum.Error("%v", res)
+				site.Forum.Error("%v", res)
 				break
 			}
 		case "stick":
 			if !u.Can(server.PERM_STICKY_PURGE) {
 				return true
 			}
-			res := common.Kforum.Store.OperateTopic(uint32(vint), server.OP_STICKY)
+			res := site.Forum.Store.OperateTopic(uint32(vint), server.OP_STICKY)
 			opcode = true
 			if res != nil {
-				common.Kforum.Error("%v", res)
+				site.Forum.Error("%v", res)
 				break
 			}
 		case "lock":
 			if !u.Can(server.PERM_LOCK_SAGE_DELETE_FLAG) {
 				return true
 			}
-			res := common.Kforum.Store.OperateTopic(uint32(vint), server.OP_LOCK)
+			res := site.Forum.Store.OperateTopic(uint32(vint), server.OP_LOCK)
+			opcode = true
+			if res != nil {
+				site.Forum.Error("%v", res)
+				break
+			}
+		case "move", "split", "merge":
+			if !u.Can(server.PERM_STICKY_PURGE) {
+				return true
+			}
 			opcode = true
+
+			// move=dstTopicID:longid,longid  split=longid,longid  merge=srcTopicID:dstTopicID
+			var res error
+			parts := strings.Split(v, ":")
+			switch {
+			case op == "split":
+				ids := parseLongIDs(v)
+				if len(ids) == 0 {
+					res = fmt.Errorf("invalid value: %s", v)
+					break
+				}
+				src, _ := server.SplitID(ids[0])
+				_, res = site.Forum.Store.SplitTopic(site.Forum.Store.GetTopic(src, server.DefaultTopicMapper).Subject, ids)
+			case len(parts) != 2:
+				res = fmt.Errorf("invalid value: %s", v)
+			case op == "move":
+				dst, _ := strconv.Atoi(parts[0])
+				res = site.Forum.Store.MovePosts(parseLongIDs(parts[1]), uint32(dst))
+			default:
+				src, _ := strconv.Atoi(parts[0])
+				dst, _ := strconv.Atoi(parts[1])
+				res = site.Forum.Store.MergeTopic(uint32(src), uint32(dst))
+			}
 			if res != nil {
-				common.Kforum.Error("%v", res)
+				site.Forum.Error("%s %v", op, res)
+				break
+			}
+		case "board":
+			if !u.Can(server.PERM_STICKY_PURGE) {
+				return true
+			}
+			opcode = true
+
+			// board=topicID:name, empty name means the main board
+			parts := strings.SplitN(v, ":", 2)
+			topicID, _ := strconv.Atoi(parts[0])
+			if _, ok := site.Forum.Board(parts[len(parts)-1]); len(parts) != 2 || !ok {
+				site.Forum.Error("invalid board: %s", v)
+				break
+			}
+			if res := site.Forum.Store.SetBoard(uint32(topicID), parts[1]); res != nil {
+				site.Forum.Error("board %v", res)
+				break
+			}
+		case "boards":
+			if !u.Can(server.PERM_ADMIN) {
+				return true
+			}
+			// boards=[{"Name":"tagged","Title":"!!标记","Cooldown":10}, ...]
+			var boards []server.Board
+			if err := json.Unmarshal([]byte(v), &boards); err != nil {
+				site.Forum.Error("invalid boards: %v", err)
+				return true
+			}
+			for _, b := range boards {
+				if !rxBoardName.MatchString(b.Name) {
+					site.Forum.Error("invalid board name: %q", b.Name)
+					return true
+				}
+			}
+			site.Forum.Boards = boards
+			opcode = true
+		case "tag", "untag":
+			if !u.Can(server.PERM_LOCK_SAGE_DELETE_FLAG) {
+				return true
+			}
+			opcode = true
+
+			// tag=topicID:tag,tag
+			parts := strings.SplitN(v, ":", 2)
+			topicID, _ := strconv.Atoi(parts[0])
+			if len(parts) != 2 {
+				site.Forum.Error("invalid tags: %s", v)
+				break
+			}
+			if res := site.Forum.Store.TagTopic(uint32(topicID), strings.Split(parts[1], ","), op == "tag"); res != nil {
+				site.Forum.Error("%s %v", op, res)
 				break
 			}
 		case "purge":
 			if !u.Can(server.PERM_STICKY_PURGE) {
 				return true
 			}
-			res := common.Kforum.Store.OperateTopic(uint32(vint), server.OP_PURGE)
+			res := site.Forum.Store.OperateTopic(uint32(vint), server.OP_PURGE)
+			opcode = true
+			if res != nil {
+				site.Forum.Error("%v", res)
+				break
+			}
+		case "unarchive", "unpurge":
+			if !u.Can(server.PERM_STICKY_PURGE) {
+				return true
+			}
+			var res error
+			if op == "unarchive" {
+				res = site.Forum.Store.UnarchiveTopic(uint32(vint))
+			} else {
+				res = site.Forum.Store.UnpurgeTopic(uint32(vint))
+			}
 			opcode = true
 			if res != nil {
-				common.Kforum.Error("%v", res)
+				site.Forum.Error("%s %v", op, res)
 				break
 			}
+			site.Archive.Remove(int(vint))
+		case "trash-days":
+			if !u.Can(server.PERM_ADMIN) {
+				return true
+			}
+			if vint < 1 {
+				site.Forum.Error("invalid trash days: %s", v)
+				break
+			}
+			site.Forum.TrashDays = int(vint)
+			opcode = true
 		case "free-reply":
 			if !u.Can(server.PERM_ADMIN) {
 				return true
 			}
-			res := common.Kforum.Store.OperateTopic(uint32(vint), server.OP_FREEREPLY)
+			res := site.Forum.Store.OperateTopic(uint32(vint), server.OP_FREEREPLY)
 			opcode = true
 			if res != nil {
-				common.Kforum.Error("%v", res)
+				site.Forum.Error("%v", res)
 				break
 			}
 		case "sage":
 			opcode = true
-			res := common.Kforum.Store.SageTopic(uint32(vint), u)
+			res := site.Forum.Store.SageTopic(uint32(vint), u)
 			if res != nil {
-				common.Kforum.Error("sage %v", res)
+				site.Forum.Error("sage %v", res)
 				break
 			}
 		case "block":
 			if !u.Can(server.PERM_BLOCK) {
 				return true
 			}
-			common.Kforum.Store.Block(server.Parse8Bytes(v))
+			site.Forum.Store.Block(server.Parse8Bytes(v))
 			opcode = true
 		case "title":
 			if !u.Can(server.PERM_ADMIN) {
 				return true
 			}
-			common.Kforum.Title = v
+			site.Forum.Title = v
 			opcode = true
 		case "max-live-topics":
 			if !u.Can(server.PERM_ADMIN) {
 				return true
 			}
-			common.Kforum.SetMaxLiveTopics(int(vint))
+			site.Forum.SetMaxLiveTopics(int(vint))
 			opcode = true
 		case "url":
 			if !u.Can(server.PERM_ADMIN) {
 				return true
 			}
-			common.Kforum.URL = v
+			site.Forum.URL = v
+			opcode = true
+		case "compact":
+			if !u.Can(server.PERM_ADMIN) {
+				return true
+			}
+			go func() {
+				start := time.Now()
+				before, after, err := site.Forum.Store.Compact()
+				if err != nil {
+					site.Forum.Error("failed to compact the store: %v", err)
+					return
+				}
+				site.Forum.Notice("compact the store from %d to %d bytes in %.2fs", before, after, time.Since(start).Seconds())
+			}()
+			opcode = true
+		case "archive":
+			if !u.Can(server.PERM_ADMIN) {
+				return true
+			}
+			go ArchiveTopics(site)
+			opcode = true
+		case "archive-every":
+			if !u.Can(server.PERM_ADMIN) {
+				return true
+			}
+			if vint < 1 {
+				site.Forum.Error("invalid archive interval: %s", v)
+				break
+			}
+			site.Forum.ArchiveEvery = int(vint)
+			opcode = true
+		case "archive-idle":
+			if !u.Can(server.PERM_ADMIN) {
+				return true
+			}
+			site.Forum.ArchiveIdle = int(vint)
+			opcode = true
+		case "reindex-archive":
+			if !u.Can(server.PERM_ADMIN) {
+				return true
+			}
+			go func() {
+				start := time.Now()
+				n, err := site.Forum.Store.RebuildArchiveIndex()
+				if err != nil {
+					site.Forum.Error("failed to rebuild the archive index: %v", err)
+					return
+				}
+				site.Forum.Notice("rebuild the archive index of %d topics in %.2fs", n, time.Since(start).Seconds())
+			}()
 			opcode = true
 		}
 	}
 
 UPDATE:
 	if opcode {
-		err := forum.UpdateConfig(common.Kforum.ForumConfig)
+		err := site.UpdateConfig(site.Forum.ForumConfig)
 		if err != nil {
-			forum.Logger.Error("update config: %v", err)
+			site.Logger.Error("update config: %v", err)
 		}
 	}
 
 	return opcode
 }
+
+// ArchiveTopics archives topics by the policy in the config of site
+func ArchiveTopics(site *common.Site) {
+	res, err := site.Forum.Archive(site.Forum.ArchivePolicy())
+	if err != nil {
+		site.Forum.Error("failed to archive topics: %v", err)
+		return
+	}
+	if res.Total() > 0 {
+		site.Forum.Notice("archive %d topics (%d over the cap, %d idle, %d over board limits) in %.2fs",
+			res.Total(), res.ByCount, res.ByIdle, res.ByBoard, res.Duration.Seconds())
+	}
+}
@@ -12,10 +12,13 @@ import (
 	"time"
 
 	"github.com/coyove/fofou/common"
+	"github.com/coyove/fofou/server"
 )
 
 var rxBot = regexp.MustCompile(`(bot|crawl|spider)`)
 
+var rxBoardName = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
 func intmin(a, b int) int {
 	if a < b {
 		return a
@@ -65,21 +68,29 @@ func getIPAddress(r *http.Request) (v [8]byte) {
 	return
 }
 
-func throtNewPost(ip, id [8]byte) bool {
+// boardForum returns the forum with the config of board applied, false if board doesn't exist
+func boardForum(site *common.Site, board string) (server.Forum, bool) {
+	cfg, ok := site.Forum.Board(board)
+	forum := *site.Forum
+	forum.ForumConfig = &cfg
+	return forum, ok
+}
+
+func throtNewPost(site *common.Site, ip, id [8]byte, cooldown int) bool {
 	if id != [8]byte{} {
 		// use ID whenever possible
 		ip = id
 	}
 
 	now := time.Now().Unix()
-	ts, ok := common.KthrotIPID.Get(ip)
+	ts, ok := site.ThrotIPID.Get(ip)
 	if !ok {
-		common.KthrotIPID.Add(ip, now)
+		site.ThrotIPID.Add(ip, now)
 		return true
 	}
 	t := ts.(int64)
-	if now-t > int64(common.Kforum.Cooldown) {
-		common.KthrotIPID.Add(ip, now)
+	if now-t > int64(cooldown) {
+		site.ThrotIPID.Add(ip, now)
 		return true
 	}
 	return false
@@ -123,3 +134,13 @@ func sanitizeFilename(name string) string {
 }
 
 var reMessage = regexp.MustCompile("(`{3,})")
+
+func parseLongIDs(v string) []uint64 {
+	ids := []uint64{}
+	for _, s := range strings.Split(v, ",") {
+		if id, err := strconv.ParseUint(strings.TrimSpace(s), 10, 64); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
@@ -2,6 +2,7 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -13,7 +14,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/coyove/common/lru"
 	"github.com/coyove/fofou/common"
 	"github.com/coyove/fofou/handler"
 	"github.com/coyove/fofou/server"
@@ -27,34 +27,79 @@ var (
 	snapshot = flag.String("ss", "", "Make snapshot of main.txt")
 	csrf     = flag.String("csrf", "", "Change the URL for CSRF protection")
 	salt     = flag.String("s", testPassword, "A secret string used as both salt and admin password")
+	fsck     = flag.String("fsck", "", "Check main.txt and its archives, report broken records")
+	repair   = flag.String("repair", "", "Used with -fsck, repair broken records: truncate or skip")
+	dump     = flag.String("dump", "", "Dump main.txt or an archived topic as JSON lines")
+	dumpT    = flag.Uint("dump-topic", 0, "Used with -dump, only dump ops of this topic")
+	dumpOp   = flag.String("dump-op", "", "Used with -dump, only dump these ops, e.g.: LOCK,SAGE,CONFIG")
+	dumpFrom = flag.Int64("dump-from", 0, "Used with -dump, start offset")
+	dumpTo   = flag.Int64("dump-to", 0, "Used with -dump, end offset (exclusive)")
+	restore  = flag.String("restore", "", "Replay main.txt to a point given by -until and write it as a snapshot")
+	until    = flag.String("until", "", "Used with -restore, an offset (e.g.: 0x1234) or a time (e.g.: 2019-05-01T12:00:00+08:00)")
+	output   = flag.String("o", "", "Used with -restore and -restore-backup, output file, default: main.txt.restore")
+	restoreB = flag.String("restore-backup", "", "Rebuild main.txt from incremental backups in the directory")
+	follow   = flag.String("follow", "", "Run as a read-only replica of the primary at this URL, e.g.: http://127.0.0.1:5010")
+	saveIdx  = flag.Bool("save-index", true, "Save the search index beside main.txt after each backup, so startup only indexes new ops")
+	thumbS   = flag.Int("thumb-small", 200, "Box size of small thumbnails, shown in posts and lists")
+	thumbM   = flag.Int("thumb-medium", 400, "Box size of medium thumbnails, shown in the images browser")
+	sitesCfg = flag.String("sites", "", "Host several forums, a JSON file like: [{\"Host\":\"a.com\",\"Dir\":\"data/a\",\"Password\":\"...\"}, ...], the first one is the default")
 )
 
-func newForum(logger *server.Logger) *server.Forum {
-	forum := &server.Forum{Logger: logger}
+func loadSites() ([]*common.Site, error) {
+	if *sitesCfg == "" {
+		return []*common.Site{common.NewSite("", common.DATA_DIR, *salt)}, nil
+	}
+
+	buf, err := ioutil.ReadFile(*sitesCfg)
+	if err != nil {
+		return nil, err
+	}
+	var cfg []struct{ Host, Dir, Password string }
+	if err := json.Unmarshal(buf, &cfg); err != nil {
+		return nil, err
+	}
+	if len(cfg) == 0 {
+		return nil, fmt.Errorf("no sites in %s", *sitesCfg)
+	}
+
+	sites, dirs := []*common.Site{}, map[string]bool{}
+	for _, c := range cfg {
+		s := common.NewSite(c.Host, c.Dir, c.Password)
+		if s.Password == "" || dirs[s.Dir] {
+			return nil, fmt.Errorf("site %q: empty password or duplicated data directory", c.Host)
+		}
+		dirs[s.Dir] = true
+		sites = append(sites, s)
+	}
+	return sites, nil
+}
+
+// newForum loads the store of site in the background
+func newForum(site *common.Site) {
+	forum := site.Forum
 
 	start := time.Now()
-	forum.Store = server.NewStore(common.DATA_MAIN,
-		(&server.ForumConfig{}).SetSalt(*salt),
-		func(store *server.Store) {
-			forum.ForumConfig = &server.ForumConfig{}
-			store.GetConfig(forum.ForumConfig)
-			forum.ForumConfig.CorrectValues()
-			forum.ForumConfig.Invalidate = time.Now().Unix()
-			forum.SetSalt(*salt)
-
-			rbuf, _ := ioutil.ReadFile(common.DATA_RECAPTCHA)
-			rparts := strings.Split(string(rbuf), "|")
-			if len(rparts) == 2 {
-				forum.RecaptchaToken = rparts[0]
-				forum.RecaptchaSecret = rparts[1]
-				forum.Notice("recaptcha token: %s, secret: %s", forum.RecaptchaToken, forum.RecaptchaSecret)
-			}
-		})
+	onload := func(store *server.Store) {
+		forum.ForumConfig = &server.ForumConfig{}
+		store.GetConfig(forum.ForumConfig)
+		forum.ForumConfig.CorrectValues()
+		forum.ForumConfig.Invalidate = time.Now().Unix()
+		forum.SetSalt(site.Password)
+
+		rbuf, _ := ioutil.ReadFile(site.Dir + common.DATA_RECAPTCHA)
+		rparts := strings.Split(string(rbuf), "|")
+		if len(rparts) == 2 {
+			forum.RecaptchaToken = rparts[0]
+			forum.RecaptchaSecret = rparts[1]
+			forum.Notice("recaptcha token: %s, secret: %s", forum.RecaptchaToken, forum.RecaptchaSecret)
+		}
+	}
+	forum.Store = server.NewStore(site.Dir+common.DATA_MAIN, (&server.ForumConfig{}).SetSalt(site.Password), onload)
 
-	common.KbadUsers = lru.NewCache(1024)
-	common.Kuuids = lru.NewCache(1024)
-	common.Karchive = lru.NewCache(256)
-	common.KthrotIPID = lru.NewCache(256)
+	if *follow != "" {
+		forum.Store.SetReadOnly()
+		go forum.Store.Follow(strings.TrimSuffix(*follow, "/"), server.ReplicaToken(site.Password), forum.Logger, onload)
+	}
 
 	go func() {
 		for {
@@ -75,25 +120,33 @@ func newForum(logger *server.Logger) *server.Forum {
 					os.Exit(0)
 				}
 
+				if _, ok := forum.Board(server.TaggedBoard); ok && !forum.IsReadOnly() {
+					if n, err := forum.MigrateTaggedTopics(server.TaggedBoard); err != nil {
+						forum.Error("failed to migrate tagged topics: %v", err)
+					} else if n > 0 {
+						forum.Notice("migrated %d tagged topics into /b/%s", n, server.TaggedBoard)
+					}
+				}
+
 				break
 			}
 		}
 	}()
-	return forum
 }
 
 var version string = "_devel_"
 
 func preHandle(fn func(http.ResponseWriter, *http.Request), footer bool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if !common.Kforum.IsReady() {
-			w.Write([]byte(fmt.Sprintf("%v Booting... %.1f%%", time.Now().Format(time.RFC1123), common.Kforum.LoadingProgress()*100)))
+		site := common.SiteOf(r)
+		if !site.IsReady() {
+			w.Write([]byte(fmt.Sprintf("%v Booting... %.1f%%", time.Now().Format(time.RFC1123), site.LoadingProgress()*100)))
 			return
 		}
 
 		ww := &server.ResponseWriterWrapper{w, http.StatusOK, false, &common.Ktraffic}
-		if !common.Kprod {
-			common.Kforum.Invalidate = time.Now().Unix()
+		if !site.Prod {
+			site.Invalidate = time.Now().Unix()
 		}
 
 		startTime := time.Now()
@@ -111,31 +164,47 @@ func preHandle(fn func(http.ResponseWriter, *http.Request), footer bool) http.Ha
 			if len(r.URL.RawQuery) > 0 {
 				url = fmt.Sprintf("%s?%s", url, r.URL.RawQuery)
 			}
-			common.Kforum.Notice("%q took %fs to serve", url, duration.Seconds())
+			site.Notice("%q took %fs to serve", url, duration.Seconds())
 		}
 		common.Ktraffic.Latency(duration.Nanoseconds())
 	}
 }
 
 func main() {
-	os.MkdirAll(common.DATA_IMAGES, 0755)
-	os.MkdirAll(common.DATA_LOGS, 0755)
-
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
 	flag.Parse()
-	logger := server.NewLogger(1024, 1024, true, common.DATA_LOGS+"f2")
-	common.Kpassword = *salt
 	common.Ktraffic.Init(3600, 10)
 
-	if *salt == testPassword {
-		logger.Notice("you are using the test password/salt, fofou will run in test mode")
-	} else {
-		logger.Notice("production mode on")
-		logger.UseStdout = true
-		common.Kprod = true
+	sites, err := loadSites()
+	if err != nil {
+		fmt.Println("sites:", err)
+		os.Exit(2)
+	}
+	if len(sites) > 1 && (*follow != "" || *snapshot != "" || *csrf != "") {
+		fmt.Println("-follow, -ss and -csrf only work with a single site")
+		os.Exit(2)
+	}
+
+	// templates are shared, they are reloaded quickly if any site is in test mode
+	prod := true
+	for _, site := range sites {
+		os.MkdirAll(site.Dir+common.DATA_IMAGES, 0755)
+		os.MkdirAll(site.Dir+common.DATA_LOGS, 0755)
+		site.Forum = &server.Forum{Logger: server.NewLogger(1024, 1024, true, site.Dir+common.DATA_LOGS+"f2")}
+		site.Prod = site.Password != testPassword
+		if !site.Prod {
+			site.Logger.Notice("you are using the test password/salt, the site will run in test mode")
+		} else {
+			site.Logger.Notice("production mode on")
+			site.Logger.UseStdout = true
+		}
+		prod = prod && site.Prod
 	}
 
+	// the default site logs for the whole process
+	logger := sites[0].Logger
+
 	if *makeID != "" {
 		u, parts := server.User{}, strings.Split(*makeID, ",")
 		copy(u.ID[:], parts[0])
@@ -149,10 +218,88 @@ func main() {
 		return
 	}
 
-	common.Kforum = newForum(logger)
-	common.Kiq = server.NewImageQueue(logger, 200, runtime.NumCPU())
+	if *fsck != "" {
+		n, err := server.Fsck(*fsck, (&server.ForumConfig{}).SetSalt(*salt), *repair, os.Stdout)
+		if err != nil {
+			fmt.Println("fsck:", err)
+			os.Exit(2)
+		}
+		if n > 0 && *repair == "" {
+			fmt.Printf("%d broken records, run again with '-repair truncate' or '-repair skip' to fix them\n", n)
+		}
+		if n > 0 {
+			os.Exit(1)
+		}
+		return
+	}
 
-	server.LoadTemplates(common.Kprod)
+	if *dump != "" {
+		ops, err := server.ParseOpNames(*dumpOp)
+		if err == nil {
+			err = server.DumpLog(*dump, (&server.ForumConfig{}).SetSalt(*salt), server.DumpFilter{
+				Topic: uint32(*dumpT),
+				Ops:   ops,
+				From:  *dumpFrom,
+				To:    *dumpTo,
+			}, os.Stdout)
+		}
+		if err != nil {
+			fmt.Println("dump:", err)
+			os.Exit(2)
+		}
+		return
+	}
+
+	if *restore != "" {
+		p := server.RestorePoint{}
+		if t, err := time.Parse(time.RFC3339, *until); err == nil {
+			p.Time = uint32(t.Unix())
+		} else {
+			p.Offset, _ = strconv.ParseInt(*until, 0, 64)
+		}
+		if *output == "" {
+			*output = *restore + ".restore"
+		}
+
+		fmt.Println("dropped ops:")
+		cutoff, err := server.Restore(*restore, (&server.ForumConfig{}).SetSalt(*salt), p, *output, os.Stdout)
+		if err != nil {
+			fmt.Println("restore:", err)
+			os.Exit(2)
+		}
+		fmt.Printf("replayed to 0x%08x, snapshot written into %s\n", cutoff, *output)
+		return
+	}
+
+	if *restoreB != "" {
+		if *output == "" {
+			*output = common.DATA_DIR + common.DATA_MAIN + ".restore"
+		}
+
+		size, err := server.RestoreBackup(*restoreB, *output, (&server.ForumConfig{}).SetSalt(*salt))
+		if err != nil {
+			fmt.Println("restore backup:", err)
+			os.Exit(2)
+		}
+		fmt.Printf("%d bytes verified, written into %s\n", size, *output)
+		return
+	}
+
+	// every site has its own thumbnail queue, the workers are split among them
+	workers := runtime.NumCPU() / len(sites)
+	if workers < 1 {
+		workers = 1
+	}
+	for _, site := range sites {
+		newForum(site)
+		site.Images = server.NewImageQueue(site.Logger, *thumbS, *thumbM, workers, site.Dir+common.DATA_THUMBS)
+		if site.Host != "" {
+			common.Ksites[site.Host] = site
+		}
+	}
+	common.Kdefault = sites[0]
+
+	server.LoadTemplates(prod)
 
 	smux := &http.ServeMux{}
 	smux.HandleFunc("/favicon.ico", http.NotFound)
@@ -164,10 +311,13 @@ func main() {
 	smux.HandleFunc("/i/", preHandle(handler.Image, false))
 	smux.HandleFunc("/api", preHandle(handler.PostAPI, false))
 	smux.HandleFunc("/list", preHandle(handler.List, true))
+	smux.HandleFunc("/archive", preHandle(handler.Archive, true))
 	smux.HandleFunc("/rss.xml", preHandle(handler.RSS, false))
 	smux.HandleFunc("/data.bin", preHandle(handler.Help, false))
+	smux.HandleFunc("/replicate", handler.Replicate)
 	smux.HandleFunc("/t/", preHandle(handler.Topic, true))
 	smux.HandleFunc("/p/", preHandle(handler.Post, false))
+	smux.HandleFunc("/b/", preHandle(handler.Topics, true))
 	smux.HandleFunc("/tagged", preHandle(handler.Topics, true))
 	smux.HandleFunc("/", preHandle(handler.Topics, true))
 
@@ -175,31 +325,99 @@ func main() {
 	srv.Addr = *listen
 	logger.Notice("running on %s", srv.Addr)
 
-	go func() {
-		for {
-			if !common.Kforum.Store.IsReady() {
-				time.Sleep(time.Second)
-				continue
-			}
+	for _, site := range sites {
+		go func(site *common.Site) {
+			for {
+				if !site.Store.IsReady() {
+					time.Sleep(time.Second)
+					continue
+				}
+
+				start := time.Now()
+				if n, err := site.Store.Backup(site.Dir + common.DATA_BACKUP); err != nil {
+					site.Error("failed to backup the store: %v", err)
+				} else {
+					site.Notice("backup %d bytes of the store in %.2fs", n, time.Since(start).Seconds())
+				}
 
-			start := time.Now()
-			if err := common.Kforum.Store.Dup(common.DATA_MAIN + ".snapshot"); err != nil {
-				logger.Error("failed to dup the store: %v", err)
+				start = time.Now()
+				if n, err := site.Store.ExportFile(site.Dir + common.DATA_SNAPSHOT); err != nil {
+					site.Error("failed to export the store: %v", err)
+				} else {
+					site.Notice("export %d bytes of the store in %.2fs", n, time.Since(start).Seconds())
+				}
+
+				if *saveIdx {
+					start = time.Now()
+					if err := site.Store.SaveIndex(); err != nil {
+						site.Error("failed to save the search index: %v", err)
+					} else {
+						site.Notice("save the search index in %.2fs", time.Since(start).Seconds())
+					}
+				}
+
+				if site.Prod {
+					time.Sleep(time.Hour * 6)
+				} else {
+					time.Sleep(time.Minute)
+				}
 			}
-			logger.Notice("dup the store in %.2fs", time.Since(start).Seconds())
+		}(site)
+
+		go func(site *common.Site) {
+			for {
+				if !site.Store.IsReady() {
+					// the config is loaded along with the store
+					time.Sleep(time.Second)
+					continue
+				}
+				every := site.Forum.ArchiveEvery
+				if every < 1 {
+					every = 1
+				}
+				time.Sleep(time.Duration(every) * time.Minute)
+				if !site.Store.IsReadOnly() {
+					handler.ArchiveTopics(site)
+				}
+			}
+		}(site)
+
+		go func(site *common.Site) {
+			for {
+				if site.Prod {
+					time.Sleep(time.Hour * 24)
+				} else {
+					time.Sleep(time.Minute * 10)
+				}
 
-			if common.Kprod {
-				time.Sleep(time.Hour * 6)
-			} else {
-				time.Sleep(time.Minute)
+				if !site.Store.IsReady() || site.Store.IsReadOnly() {
+					continue
+				}
+
+				if n, err := site.Store.EmptyTrash(site.Forum.TrashDays, site.RemoveImage); err != nil {
+					site.Error("failed to empty the trash: %v", err)
+				} else if n > 0 {
+					site.Notice("remove %d topics from the trash", n)
+				}
+
+				start := time.Now()
+				before, after, err := site.Store.Compact()
+				if err != nil {
+					site.Error("failed to compact the store: %v", err)
+					continue
+				}
+				site.Notice("compact the store from %d to %d bytes in %.2fs", before, after, time.Since(start).Seconds())
 			}
-		}
-	}()
+		}(site)
+	}
 
 	go func() {
 		for range time.Tick(time.Minute) {
 			common.Ktraffic.Update()
-			ioutil.WriteFile(filepath.Join(common.DATA_IMAGES, "traffic.svg"), common.Ktraffic.SVG(300, 50, false).Bytes(), 0755)
+			svg := common.Ktraffic.SVG(300, 50, false).Bytes()
+			for _, site := range sites {
+				ioutil.WriteFile(filepath.Join(site.Dir, common.DATA_IMAGES, "traffic.svg"), svg, 0755)
+			}
 		}
 	}()
 
@@ -1,7 +1,25 @@
 package server
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+	"unicode/utf8"
 
 	"github.com/coyove/common/rand"
 )
@@ -50,6 +68,58 @@ func TestBufferReadWriteRandom(t *testing.T) {
 	}
 }
 
+func TestBufferReadWriteUTF8(t *testing.T) {
+	r := rand.New()
+	buf := []rune("emoji 😀, 𠀀 and \x00")
+	for i := 0; i < 1024; i++ {
+		if x := rune(r.Intn(utf8.MaxRune) + 1); utf8.ValidRune(x) {
+			buf = append(buf, x)
+		}
+	}
+
+	b := buffer{utf8: true}
+	b.WriteString(string(buf))
+	b.WriteString(str)
+
+	b2 := buffer{utf8: true}
+	b2.SetReader(&b.p)
+
+	if str2, err := b2.ReadString(); err != nil || str2 != string(buf) {
+		t.Fatal(err)
+	}
+	if str2, err := b2.ReadString(); err != nil || str2 != str {
+		t.Fatal(err)
+	}
+}
+
+func TestSnapshotUpgrade(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "fofou")
+	defer os.RemoveAll(dir)
+
+	// a legacy store
+	path := filepath.Join(dir, "main.txt")
+	ioutil.WriteFile(path, []byte{'z', 'z', 'z', 0, 0, 0, 0, 0, 0, 0x10, 0, 0, 0, 0, 0, 0x10}, 0755)
+
+	store := openTestStore(t, path)
+	if store.utf8 {
+		t.Fatal("legacy store loaded as UTF-8")
+	}
+	store.NewTopic("old", "BMP only 你好", nil, [8]byte{}, [8]byte{}, false)
+
+	SnapshotStore(path+".ss", store)
+	store = openTestStore(t, path+".ss")
+	if !store.utf8 {
+		t.Fatal("snapshot is not in UTF-8")
+	}
+	store.NewTopic("new", "😀", nil, [8]byte{}, [8]byte{}, false)
+
+	store = openTestStore(t, path+".ss")
+	topics := store.GetTopics(0, 2, DefaultTopicFilter, DefaultTopicMapper)
+	if len(topics) != 2 || topics[0].Posts[0].Message != "😀" || topics[1].Posts[0].Message != "BMP only 你好" {
+		t.Fatal("snapshot mismatch")
+	}
+}
+
 func TestBufferError(t *testing.T) {
 	b := buffer{}
 	b.WriteUInt32(42)
@@ -100,3 +170,1327 @@ func TestLongID(t *testing.T) {
 		}
 	}
 }
+
+func newTestStore(t *testing.T) (*Store, string) {
+	dir, err := ioutil.TempDir("", "fofou")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "main.txt")
+	return openTestStore(t, path), path
+}
+
+func openTestStore(t *testing.T, path string) *Store {
+	store := NewStore(path, (&ForumConfig{}).SetSalt("test"), nil)
+	for !store.IsReady() || store.dataFile == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return store
+}
+
+func TestTopicIndex(t *testing.T) {
+	store, path := newTestStore(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	var ids []uint32
+	for i := 0; i < 10; i++ {
+		longID, err := store.NewTopic("subject", "message", nil, [8]byte{}, [8]byte{}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		topicID, _ := SplitID(longID)
+		ids = append(ids, topicID)
+	}
+
+	if _, err := store.NewPost(ids[3], "reply", nil, [8]byte{}, [8]byte{}, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.OperateTopic(ids[5], OP_PURGE); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetMaxLiveTopics(5); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(store *Store) {
+		if len(store.topics) != store.LiveTopicsNum {
+			t.Fatalf("index has %d topics, %d live", len(store.topics), store.LiveTopicsNum)
+		}
+		for topic := store.rootTopic.Next; topic != store.endTopic; topic = topic.Next {
+			if store.topicByIDUnlocked(topic.ID) != topic {
+				t.Fatalf("topic %d is not indexed", topic.ID)
+			}
+		}
+		if store.topicByIDUnlocked(ids[5]) != nil {
+			t.Fatal("purged topic is still indexed")
+		}
+		if len(store.GetTopic(ids[3], DefaultTopicMapper).Posts) != 2 {
+			t.Fatal("can't find the replied topic")
+		}
+	}
+
+	check(store)
+	check(openTestStore(t, path))
+}
+
+func TestCompact(t *testing.T) {
+	store, path := newTestStore(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	for i := 0; i < 10; i++ {
+		longID, _ := store.NewTopic("subject", "message", nil, [8]byte{}, [8]byte{}, false)
+		topicID, _ := SplitID(longID)
+		if i%2 == 0 {
+			store.OperateTopic(topicID, OP_PURGE)
+		}
+	}
+
+	before, after, err := store.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after >= before {
+		t.Fatalf("compact: %d -> %d", before, after)
+	}
+
+	store.NewTopic("after", "compact", nil, [8]byte{}, [8]byte{}, false)
+	if fi, _ := os.Stat(path); fi.Size() != store.ptr {
+		t.Fatal("appended to the old file")
+	}
+
+	store2 := openTestStore(t, path)
+	if store2.LiveTopicsNum != 6 || store2.TopicsCount() != 11 {
+		t.Fatal("compacted store mismatch", store2.LiveTopicsNum, store2.TopicsCount())
+	}
+}
+
+func TestFsck(t *testing.T) {
+	store, path := newTestStore(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	var ids []uint32
+	for i := 0; i < 5; i++ {
+		longID, _ := store.NewTopic("subject", "message", nil, [8]byte{}, [8]byte{}, false)
+		topicID, _ := SplitID(longID)
+		ids = append(ids, topicID)
+	}
+	store.NewPost(ids[1], "broken reply", nil, [8]byte{}, [8]byte{}, false)
+	store.NewPost(ids[2], "good reply", nil, [8]byte{}, [8]byte{}, false)
+	store.OperateTopic(ids[1], OP_LOCK)
+
+	buf, _ := ioutil.ReadFile(path)
+	idx := bytes.Index(buf, []byte("broken reply"))
+	buf[idx] = 'B'
+	ioutil.WriteFile(path, buf, 0755)
+
+	password := (&ForumConfig{}).SetSalt("test")
+	if n, _ := Fsck(path, password, "", ioutil.Discard); n != 1 {
+		t.Fatal("broken records:", n)
+	}
+	if n, _ := Fsck(path, password, "skip", ioutil.Discard); n != 1 {
+		t.Fatal("skipped records:", n)
+	}
+	if n, _ := Fsck(path, password, "", ioutil.Discard); n != 0 {
+		t.Fatal("still broken:", n)
+	}
+
+	store = openTestStore(t, path)
+	if len(store.GetTopic(ids[1], DefaultTopicMapper).Posts) != 1 ||
+		len(store.GetTopic(ids[2], DefaultTopicMapper).Posts) != 2 ||
+		!store.GetTopic(ids[1], DefaultTopicMapper).Locked {
+		t.Fatal("repaired store mismatch")
+	}
+
+	if q, _ := ioutil.ReadFile(path + ".quarantine"); !bytes.Contains(q, []byte("Broken reply")) {
+		t.Fatal("quarantine mismatch")
+	}
+}
+
+func TestDump(t *testing.T) {
+	store, path := newTestStore(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	longID, _ := store.NewTopic("subject", "message", nil, [8]byte{'u', 's', 'e', 'r'}, [8]byte{}, false)
+	topicID, _ := SplitID(longID)
+	store.NewTopic("other", "message", nil, [8]byte{}, [8]byte{}, false)
+	store.NewPost(topicID, "reply", nil, [8]byte{}, [8]byte{}, false)
+	store.OperateTopic(topicID, OP_LOCK)
+
+	buf := &bytes.Buffer{}
+	password := (&ForumConfig{}).SetSalt("test")
+	if err := DumpLog(path, password, DumpFilter{Topic: topicID}, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var ops []string
+	for dec := json.NewDecoder(buf); ; {
+		l := dumpLine{}
+		if dec.Decode(&l) != nil {
+			break
+		}
+		if l.Op == "POST" && l.Post == 1 && l.User != "*user" {
+			t.Fatal("user mismatch:", l.User)
+		}
+		ops = append(ops, l.Op)
+	}
+	if strings.Join(ops, ",") != "TOPIC,POST,POST,LOCK" {
+		t.Fatal("ops mismatch:", ops)
+	}
+
+	buf.Reset()
+	lock, _ := ParseOpNames("lock")
+	DumpLog(path, password, DumpFilter{Ops: lock}, buf)
+	if !strings.Contains(buf.String(), `"state":true`) || strings.Count(buf.String(), "\n") != 1 {
+		t.Fatal("lock mismatch:", buf.String())
+	}
+}
+
+func TestRestore(t *testing.T) {
+	store, path := newTestStore(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	longID, _ := store.NewTopic("subject", "message", nil, [8]byte{}, [8]byte{}, false)
+	topicID, _ := SplitID(longID)
+	store.NewPost(topicID, "reply", nil, [8]byte{}, [8]byte{}, false)
+	ptr := store.ptr
+	store.OperateTopic(topicID, OP_PURGE)
+	store.NewTopic("other", "message", nil, [8]byte{}, [8]byte{}, false)
+
+	buf := &bytes.Buffer{}
+	output := path + ".restore"
+	password := (&ForumConfig{}).SetSalt("test")
+	if cutoff, err := Restore(path, password, RestorePoint{Offset: ptr}, output, buf); err != nil || cutoff != ptr {
+		t.Fatal(cutoff, err)
+	}
+	if strings.Count(buf.String(), "\n") != 4 {
+		t.Fatal("dropped ops mismatch:", buf.String())
+	}
+
+	store = openTestStore(t, output)
+	if store.LiveTopicsNum != 1 || len(store.GetTopic(topicID, DefaultTopicMapper).Posts) != 2 {
+		t.Fatal("restored store mismatch")
+	}
+
+	buf.Reset()
+	Restore(path, password, RestorePoint{Time: uint32(time.Now().Unix()) - 100}, output, buf)
+	if store = openTestStore(t, output); store.LiveTopicsNum != 0 || strings.Count(buf.String(), "\n") != 7 {
+		t.Fatal("restored store mismatch:", buf.String())
+	}
+
+	// a purge after the time is dropped even without a later post
+	store, path = newTestStore(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	store.NewTopic("subject", "message", nil, [8]byte{}, [8]byte{}, false)
+	until := uint32(time.Now().Unix())
+	time.Sleep(time.Until(time.Unix(int64(until)+1, 0)))
+	store.OperateTopic(topicID, OP_PURGE)
+
+	buf.Reset()
+	Restore(path, password, RestorePoint{Time: until}, output, buf)
+	if store = openTestStore(t, output); store.LiveTopicsNum != 1 || !strings.Contains(buf.String(), "PURGE") {
+		t.Fatal("restored store mismatch:", buf.String())
+	}
+
+	// so is a split, which has no OP_POST
+	store, path = newTestStore(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	longID, _ = store.NewTopic("subject", "message", nil, [8]byte{}, [8]byte{}, false)
+	topicID, _ = SplitID(longID)
+	reply, _ := store.NewPost(topicID, "reply", nil, [8]byte{}, [8]byte{}, false)
+	until = uint32(time.Now().Unix())
+	time.Sleep(time.Until(time.Unix(int64(until)+1, 0)))
+	store.SplitTopic("split", []uint64{reply})
+
+	buf.Reset()
+	Restore(path, password, RestorePoint{Time: until}, output, buf)
+	store = openTestStore(t, output)
+	if p := store.GetTopic(topicID, DefaultTopicMapper).Posts; store.LiveTopicsNum != 1 || len(p) != 2 || p[1].IsMoved() || !strings.Contains(buf.String(), "MOVE") {
+		t.Fatal("restored store mismatch:", buf.String())
+	}
+}
+
+func TestBackup(t *testing.T) {
+	store, path := newTestStore(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	dir := filepath.Join(filepath.Dir(path), "backup")
+	output := path + ".restore"
+	password := (&ForumConfig{}).SetSalt("test")
+
+	longID, _ := store.NewTopic("subject", "message", nil, [8]byte{}, [8]byte{}, false)
+	topicID, _ := SplitID(longID)
+	if n, err := store.Backup(dir); err != nil || n != store.ptr {
+		t.Fatal(n, err)
+	}
+	if n, _ := store.Backup(dir); n != 0 {
+		t.Fatal("nothing should be copied:", n)
+	}
+
+	ptr := store.ptr
+	store.NewPost(topicID, "reply", nil, [8]byte{}, [8]byte{}, false)
+	if n, _ := store.Backup(dir); n != store.ptr-ptr {
+		t.Fatal("tail mismatch:", n)
+	}
+	if m, _ := readBackupManifest(dir); len(m.Segments) != 2 {
+		t.Fatal("segments mismatch:", m.Segments)
+	}
+	if size, err := RestoreBackup(dir, output, password); err != nil || size != store.ptr {
+		t.Fatal(size, err)
+	}
+	if s := openTestStore(t, output); len(s.GetTopic(topicID, DefaultTopicMapper).Posts) != 2 {
+		t.Fatal("restored store mismatch")
+	}
+
+	// a compacted data file starts a new chain
+	store.NewTopic("other", "message", nil, [8]byte{}, [8]byte{}, false)
+	store.OperateTopic(topicID, OP_PURGE)
+	store.Compact()
+	if n, _ := store.Backup(dir); n != store.ptr {
+		t.Fatal("full copy expected:", n)
+	}
+	m, _ := readBackupManifest(dir)
+	if len(m.Segments) != 1 {
+		t.Fatal("segments mismatch:", m.Segments)
+	}
+
+	seg := filepath.Join(dir, m.Segments[0].Name)
+	buf, _ := ioutil.ReadFile(seg)
+	buf[len(buf)-1]++
+	ioutil.WriteFile(seg, buf, 0755)
+	if _, err := RestoreBackup(dir, output, password); err == nil {
+		t.Fatal("broken segment should be detected")
+	}
+}
+
+func TestReplica(t *testing.T) {
+	primary, path := newTestStore(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	replica, rpath := newTestStore(t)
+	defer os.RemoveAll(filepath.Dir(rpath))
+	replica.SetReadOnly()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		offset, _ := strconv.ParseInt(r.FormValue("offset"), 10, 64)
+		err := primary.ReadLog(offset, r.FormValue("digest"), time.Second, func(end int64, rd io.Reader) error {
+			w.Header().Add("X-Log-Size", strconv.FormatInt(end, 10))
+			_, err := io.Copy(w, rd)
+			return err
+		})
+		if err == ErrLogMismatch {
+			w.WriteHeader(http.StatusConflict)
+		}
+	}))
+	defer srv.Close()
+
+	logger := NewLogger(16, 16, false, filepath.Join(filepath.Dir(rpath), "log"))
+	longID, _ := primary.NewTopic("subject", "message", nil, [8]byte{}, [8]byte{}, false)
+	topicID, _ := SplitID(longID)
+	primary.UpdateConfig(&ForumConfig{Title: "replica"})
+	if _, err := replica.pull(srv.URL, "", logger, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// long-poll returns as soon as a reply is appended
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		primary.NewPost(topicID, "reply", nil, [8]byte{}, [8]byte{}, false)
+	}()
+	if n, err := replica.pull(srv.URL, "", logger, nil); err != nil || n == 0 {
+		t.Fatal(n, err)
+	}
+	if len(replica.GetTopic(topicID, DefaultTopicMapper).Posts) != 2 || !strings.Contains(replica.configStr, "replica") {
+		t.Fatal("replica mismatch")
+	}
+	if _, err := replica.NewTopic("subject", "message", nil, [8]byte{}, [8]byte{}, false); err == nil {
+		t.Fatal("replica should be read-only")
+	}
+
+	// after compaction, the replica starts over
+	primary.OperateTopic(topicID, OP_PURGE)
+	primary.NewTopic("other", "message", nil, [8]byte{}, [8]byte{}, false)
+	primary.Compact()
+	if _, err := replica.pull(srv.URL, "", logger, nil); err != ErrLogMismatch {
+		t.Fatal(err)
+	}
+	replica.reset()
+	if _, err := replica.pull(srv.URL, "", logger, nil); err != nil {
+		t.Fatal(err)
+	}
+	if replica.ptr != primary.ptr || replica.LiveTopicsNum != 1 {
+		t.Fatal("replica mismatch after compaction")
+	}
+	if s := openTestStore(t, rpath); s.LiveTopicsNum != 1 {
+		t.Fatal("replica file mismatch")
+	}
+}
+
+func TestEditPost(t *testing.T) {
+	store, path := newTestStore(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	author := User{ID: [8]byte{'a', 'u', 't', 'h', 'o', 'r'}}
+	longID, _ := store.NewTopic("subject", "v1", nil, author.ID, [8]byte{}, false)
+	topicID, _ := SplitID(longID)
+
+	if store.EditPost(User{ID: [8]byte{'o', 't', 'h', 'e', 'r'}}, longID, "v2", 600) != ErrEditDenied {
+		t.Fatal("others can't edit the post")
+	}
+	if store.EditPost(author, longID, "v2", -1) != ErrEditExpired {
+		t.Fatal("the edit window has passed")
+	}
+	store.OperateTopic(topicID, OP_LOCK)
+	if store.EditPost(author, longID, "v2", 600) != ErrEditLocked {
+		t.Fatal("the topic is locked")
+	}
+	store.OperateTopic(topicID, OP_LOCK)
+	if err := store.EditPost(author, longID, "v2", 600); err != nil {
+		t.Fatal(err)
+	}
+	store.AppendPost(longID, "+")
+	if err := store.EditPost(User{M: PERM_APPEND_ANNOUNCE}, longID, "v3", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(p Post) {
+		if p.Message != "v3" || len(p.Revisions) != 2 || p.Revisions[0].Message != "v1" || p.Revisions[1].Message != "v2+" || p.EditedAt == 0 {
+			t.Fatal("revisions mismatch:", p.Message, p.Revisions)
+		}
+	}
+	check(store.GetTopic(topicID, DefaultTopicMapper).Posts[0])
+	check(openTestStore(t, path).GetTopic(topicID, DefaultTopicMapper).Posts[0])
+
+	store.Compact()
+	check(openTestStore(t, path).GetTopic(topicID, DefaultTopicMapper).Posts[0])
+
+	archive(store.topics[topicID], store.buildArchivePath(topicID))
+	topic, err := store.LoadArchivedTopic(topicID, (&ForumConfig{}).SetSalt("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(topic.Posts[0])
+}
+
+func TestMovePosts(t *testing.T) {
+	store, path := newTestStore(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	users := [][8]byte{{'u', 's', 'e', 'r', 'a'}, {'u', 's', 'e', 'r', 'b'}, {'u', 's', 'e', 'r', 'c'}}
+	longID, _ := store.NewTopic("a", "a1", nil, users[0], [8]byte{}, false)
+	a, _ := SplitID(longID)
+	a2, _ := store.NewPost(a, "a2", nil, users[1], [8]byte{}, false)
+	a3, _ := store.NewPost(a, "a3", nil, users[2], [8]byte{}, false)
+	longID, _ = store.NewTopic("b", "b1", nil, users[0], [8]byte{}, false)
+	b, _ := SplitID(longID)
+
+	if store.MovePosts([]uint64{LongID(a, 1)}, b) == nil || store.MovePosts([]uint64{a2, a2}, b) == nil {
+		t.Fatal("first posts and duplicates can't be moved")
+	}
+	if err := store.MovePosts([]uint64{a2}, b); err != nil {
+		t.Fatal(err)
+	}
+	c, err := store.SplitTopic("c", []uint64{a3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.MergeTopic(c, b); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(store *Store) {
+		ta, tb := store.GetTopic(a, DefaultTopicMapper), store.GetTopic(b, DefaultTopicMapper)
+		if len(ta.Posts) != 3 || !ta.Posts[1].IsMoved() || !ta.Posts[2].IsMoved() || len(tb.Posts) != 3 {
+			t.Fatal("posts mismatch")
+		}
+		for i, p := range tb.Posts[1:] {
+			if p.Message != fmt.Sprintf("a%d", i+2) || p.UserXor() != users[i+1] {
+				t.Fatal("moved post mismatch:", p.Message, p.UserXor())
+			}
+		}
+		if store.GetTopic(c, DefaultTopicMapper).ID != 0 || store.LiveTopicsNum != 2 {
+			t.Fatal("merged topic should be purged")
+		}
+		if store.Redirect(a2) != tb.Posts[1].LongID() || store.Redirect(a3) != tb.Posts[2].LongID() || store.Redirect(LongID(c, 1)) != tb.Posts[2].LongID() {
+			t.Fatal("redirects mismatch")
+		}
+	}
+	check(store)
+	check(openTestStore(t, path))
+	store.Compact()
+	check(openTestStore(t, path))
+
+	// old long IDs still work
+	if err := store.DeletePost(User{M: PERM_LOCK_SAGE_DELETE_FLAG}, a3, false, func(*Image) {}); err != nil {
+		t.Fatal(err)
+	}
+	if !store.GetTopic(b, DefaultTopicMapper).Posts[2].IsDeleted() {
+		t.Fatal("delete via redirect failed")
+	}
+}
+
+func TestContinuePost(t *testing.T) {
+	store, path := newTestStore(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	longID, _ := store.NewTopic("general", "1", nil, [8]byte{}, [8]byte{}, false)
+	a, _ := SplitID(longID)
+	for i := 2; i <= 7; i++ {
+		if _, err := store.ContinuePost(a, 3, fmt.Sprint(i), nil, [8]byte{}, [8]byte{}, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(store *Store) {
+		ta := store.GetTopic(a, DefaultTopicMapper)
+		tb := store.GetTopic(ta.ContinuedBy, DefaultTopicMapper)
+		tc := store.GetTopic(tb.ContinuedBy, DefaultTopicMapper)
+		if !ta.Locked || !tb.Locked || tc.Locked || tb.ContinuedFrom != a || tc.ContinuedFrom != tb.ID || tc.ContinuedBy != 0 {
+			t.Fatal("continuation links mismatch")
+		}
+		if tb.Subject != "general #2" || tc.Subject != "general #3" || tc.Posts[0].Message != "7" || len(tb.Posts) != 3 {
+			t.Fatal("continuation mismatch:", tb.Subject, tc.Subject, tc.Posts[0].Message)
+		}
+	}
+	check(store)
+	check(openTestStore(t, path))
+	store.Compact()
+	check(openTestStore(t, path))
+
+	// a continuation locked by moderators takes no posts
+	store.OperateTopic(a+2, OP_LOCK)
+	if _, err := store.ContinuePost(a, 3, "8", nil, [8]byte{}, [8]byte{}, false); err != ErrTopicLocked {
+		t.Fatal("posted to a locked continuation:", err)
+	}
+	store.OperateTopic(a+2, OP_LOCK)
+
+	// without a limit, the topic is locked at 4000 posts
+	longID, _ = store.NewTopic("full", "1", nil, [8]byte{}, [8]byte{}, false)
+	e, _ := SplitID(longID)
+	for i := 2; i <= 4000; i++ {
+		store.NewPost(e, "x", nil, [8]byte{}, [8]byte{}, false)
+	}
+	if _, err := store.NewPost(e, "x", nil, [8]byte{}, [8]byte{}, false); err != errTooManyPosts {
+		t.Fatal("posted over 4000 posts:", err)
+	}
+	if _, err := store.NewPost(e, "x", nil, [8]byte{}, [8]byte{}, false); err != ErrTopicLocked {
+		t.Fatal("posted to a full topic:", err)
+	}
+	if topic := openTestStore(t, path).GetTopic(e, DefaultTopicMapper); !topic.Locked || topic.ContinuedBy != 0 {
+		t.Fatal("full topic mismatch")
+	}
+
+	// only continuations are numbered on
+	longID, _ = store.NewTopic("season #5", "1", nil, [8]byte{}, [8]byte{}, false)
+	d, _ := SplitID(longID)
+	store.ContinuePost(d, 1, "2", nil, [8]byte{}, [8]byte{}, false)
+	if s := store.GetTopic(store.GetTopic(d, DefaultTopicMapper).ContinuedBy, DefaultTopicMapper).Subject; s != "season #5 #2" {
+		t.Fatal("subject mismatch:", s)
+	}
+
+	archive(store.topics[a], store.buildArchivePath(a))
+	topic, err := store.LoadArchivedTopic(a, (&ForumConfig{}).SetSalt("test"))
+	if err != nil || topic.ContinuedBy != a+1 {
+		t.Fatal("archived topic should keep the link", err)
+	}
+}
+
+func TestBoards(t *testing.T) {
+	store, path := newTestStore(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	store.NewTopic("!!old", "tagged", nil, [8]byte{}, [8]byte{}, false)
+	for i := 0; i < 5; i++ {
+		store.NewTopicIn("pics", fmt.Sprint(i), "pic", nil, [8]byte{}, [8]byte{}, false)
+		store.NewTopic(fmt.Sprint(i), "main", nil, [8]byte{}, [8]byte{}, false)
+	}
+	if n, err := store.MigrateTaggedTopics(TaggedBoard); n != 1 || err != nil {
+		t.Fatal("migrate:", n, err)
+	}
+	if err := store.SetBoard(2, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(store *Store) {
+		if store.CountTopics(BoardFilter("")) != 6 || store.CountTopics(BoardFilter("pics")) != 4 || store.CountTopics(BoardFilter(TaggedBoard)) != 1 {
+			t.Fatal("boards mismatch")
+		}
+		topics := store.GetTopics(2, 3, BoardFilter("pics"), DefaultTopicMapper)
+		if len(topics) != 2 || topics[0].Subject != "2" || topics[1].Subject != "1" {
+			t.Fatal("paging mismatch:", topics)
+		}
+	}
+	check(store)
+	check(openTestStore(t, path))
+	store.Compact()
+	check(openTestStore(t, path))
+
+	config := &ForumConfig{Cooldown: 2, MaxMessageLen: 100}
+	config.CorrectValues()
+	config.Boards = append(config.Boards, Board{Name: "pics", Cooldown: 10, NoImageUpload: true})
+	if c, ok := config.Board("pics"); !ok || c.Cooldown != 10 || !c.NoImageUpload || c.MaxMessageLen != 100 {
+		t.Fatal("board config mismatch")
+	}
+	if _, ok := config.Board("nope"); ok {
+		t.Fatal("unknown board")
+	}
+}
+
+func TestTags(t *testing.T) {
+	store, path := newTestStore(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	for i := 0; i < 4; i++ {
+		store.NewTopic(fmt.Sprint(i), "topic", nil, [8]byte{}, [8]byte{}, false)
+	}
+	if store.TagTopic(1, []string{"a b"}, true) == nil || store.TagTopic(9, []string{"go"}, true) == nil {
+		t.Fatal("invalid tags and topics")
+	}
+	store.TagTopic(1, []string{"Go", "#news"}, true)
+	store.TagTopic(2, []string{"go"}, true)
+	store.TagTopic(3, []string{"go", "news"}, true)
+	store.TagTopic(3, []string{"news", "none"}, false)
+
+	check := func(store *Store) {
+		if store.TaggedNum("go") != 3 || store.TaggedNum("news") != 1 || len(store.Tags()) != 2 {
+			t.Fatal("tag index mismatch:", store.Tags())
+		}
+		if topics := store.GetTaggedTopics("go", 1, 5, DefaultTopicMapper); len(topics) != 2 || topics[0].ID != 2 || topics[1].ID != 1 {
+			t.Fatal("tagged topics mismatch")
+		}
+		q, _ := ParseQuery("!!news")
+		if posts, total := store.Search(q, 0, 10, 0); total != 1 || posts[0].Topic.ID != 1 {
+			t.Fatal("search mismatch")
+		}
+		if tags := store.GetTopic(1, DefaultTopicMapper).Tags; len(tags) != 2 || tags[0] != "go" || tags[1] != "news" {
+			t.Fatal("tags mismatch:", tags)
+		}
+	}
+	check(store)
+	check(openTestStore(t, path))
+	store.Compact()
+	check(openTestStore(t, path))
+
+	// the index is ordered like the live list
+	store.OperateTopic(1, OP_STICKY)
+	store.NewPost(2, "bump", nil, [8]byte{}, [8]byte{}, false)
+	a, b := store.GetTaggedTopics("go", 0, 5, DefaultTopicMapper), store.GetTopics(0, 5, TagFilter("go"), DefaultTopicMapper)
+	if len(a) != 3 || len(b) != 3 || a[0].ID != 1 || a[1].ID != 2 || a[1].ID != b[1].ID || a[2].ID != b[2].ID {
+		t.Fatal("tagged topics order mismatch")
+	}
+
+	store.OperateTopic(2, OP_PURGE)
+	if store.TaggedNum("go") != 2 {
+		t.Fatal("purged topic is still indexed")
+	}
+	archive(store.topics[1], store.buildArchivePath(1))
+	topic, err := store.LoadArchivedTopic(1, (&ForumConfig{}).SetSalt("test"))
+	if err != nil || len(topic.Tags) != 2 {
+		t.Fatal("archived topic should keep tags", err)
+	}
+}
+
+func TestSearchIndex(t *testing.T) {
+	store, path := newTestStore(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	longID, _ := store.NewTopic("Hello World", "first post", nil, [8]byte{}, [8]byte{}, false)
+	a, _ := SplitID(longID)
+	a2, _ := store.NewPost(a, "这是中文", nil, [8]byte{}, [8]byte{}, false)
+	a3, _ := store.NewPost(a, "old text", nil, [8]byte{}, [8]byte{}, false)
+	longID, _ = store.NewTopic("b", "another world", nil, [8]byte{}, [8]byte{}, false)
+	b, _ := SplitID(longID)
+
+	store.EditPost(User{M: PERM_APPEND_ANNOUNCE}, a3, "new text", 0)
+	store.AppendPost(a3, " appended")
+	store.DeletePost(User{M: PERM_LOCK_SAGE_DELETE_FLAG}, a2, false, nil)
+	store.MovePosts([]uint64{a3}, b)
+
+	search := func(store *Store, q string) []uint64 {
+		query, err := ParseQuery(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		posts, total := store.Search(query, 0, 10, 0)
+		ids := []uint64{}
+		for _, p := range posts {
+			ids = append(ids, p.LongID())
+		}
+		if total != len(ids) {
+			t.Fatal("total mismatch:", q, total, ids)
+		}
+		return ids
+	}
+
+	check := func(store *Store) {
+		if ids := search(store, "WORLD"); len(ids) != 2 || ids[0] != LongID(b, 1) || ids[1] != LongID(a, 1) {
+			t.Fatal("search mismatch:", ids)
+		}
+		if len(search(store, "中文")) != 0 || len(search(store, "old")) != 0 {
+			t.Fatal("deleted and edited text is still indexed")
+		}
+		if ids := search(store, "appended text"); len(ids) != 1 || ids[0] != LongID(b, 2) {
+			t.Fatal("moved post mismatch:", ids)
+		}
+	}
+	check(store)
+	check(openTestStore(t, path))
+
+	if err := store.SaveIndex(); err != nil {
+		t.Fatal(err)
+	}
+	store.NewPost(a, "after saving", nil, [8]byte{}, [8]byte{}, false)
+	s := openTestStore(t, path)
+	if s.index.from == 0 {
+		t.Fatal("saved index is not loaded")
+	}
+	check(s)
+	if len(search(s, "saving")) != 1 {
+		t.Fatal("ops after the saved index are not indexed")
+	}
+
+	// the saved index doesn't match the compacted file
+	store.Compact()
+	if s := openTestStore(t, path); s.index.from != 0 || len(search(s, "saving")) != 1 {
+		t.Fatal("index should be rebuilt")
+	}
+
+	store.OperateTopic(b, OP_PURGE)
+	if ids := search(store, "world"); len(ids) != 1 || ids[0] != LongID(a, 1) {
+		t.Fatal("purged topic is still indexed:", ids)
+	}
+}
+
+func TestSearchIndexCompact(t *testing.T) {
+	store, path := newTestStore(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	for i := 0; i < 20; i++ {
+		longID, _ := store.NewTopic("subject", "some long message to make the file bigger", nil, [8]byte{}, [8]byte{}, false)
+		if id, _ := SplitID(longID); i > 0 {
+			store.OperateTopic(id, OP_PURGE)
+		}
+	}
+	if err := store.SaveIndex(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the compacted file is shorter than where the saved index stops
+	s := openTestStore(t, path)
+	if _, _, err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	s.NewTopic("zebra", "zebra unicorn", nil, [8]byte{}, [8]byte{}, false)
+	q, _ := ParseQuery("zebra unicorn")
+	if _, total := s.Search(q, 0, 10, 0); total != 1 {
+		t.Fatal("posts after compacting are not indexed")
+	}
+}
+
+func TestSearchQuery(t *testing.T) {
+	store, path := newTestStore(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	if _, err := ParseQuery("is:nothing"); err == nil {
+		t.Fatal("unknown operator")
+	}
+	if q, err := ParseQuery(`see http://a.com "Hello  World" has:image after:2019-05-01 before:2019-05-02 "open`); err != nil ||
+		q.Text != "see http://a.com" || len(q.Phrases) != 2 || q.Phrases[0] != "hello  world" || q.Phrases[1] != "open" ||
+		!q.HasImage || q.Before-q.After != 86400 {
+		t.Fatal("parse mismatch:", q, err)
+	}
+
+	users := [][8]byte{{'u', 's', 'e', 'r', 'a'}, {'u', 's', 'e', 'r', 'b'}}
+	longID, _ := store.NewTopic("apple pie", "recipe", nil, users[0], [8]byte{}, false)
+	a, _ := SplitID(longID)
+	a2, _ := store.NewPost(a, "apple juice", &Image{Path: "x.png"}, users[1], [8]byte{}, false)
+	a3, _ := store.NewPost(a, "juice apple", nil, users[1], [8]byte{}, false)
+	for i := 0; i < 5; i++ {
+		store.NewPost(a, "apple", nil, users[0], [8]byte{}, false)
+	}
+	store.DeletePost(User{M: PERM_LOCK_SAGE_DELETE_FLAG}, a3, false, nil)
+
+	search := func(text string, start int) ([]Post, int) {
+		q, err := ParseQuery(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store.Search(q, start, 3, 1e9)
+	}
+
+	if posts, total := search("apple", 0); total != 7 || len(posts) != 3 || posts[0].ID != 8 {
+		t.Fatal("paging mismatch:", total)
+	}
+	if posts, total := search("apple", 6); total != 7 || len(posts) != 1 || posts[0].ID != 1 {
+		t.Fatal("last page mismatch:", total)
+	}
+	if posts, total := search(`"apple juice"`, 0); total != 1 || posts[0].LongID() != a2 {
+		t.Fatal("phrase mismatch:", total)
+	}
+	if posts, total := search("has:image", 0); total != 1 || posts[0].LongID() != a2 {
+		t.Fatal("has:image mismatch:", total)
+	}
+	if posts, total := search("is:op apple", 0); total != 1 || posts[0].ID != 1 {
+		t.Fatal("is:op mismatch:", total)
+	}
+	if posts, total := search("is:deleted juice", 0); total != 1 || posts[0].LongID() != a3 {
+		t.Fatal("is:deleted mismatch:", total)
+	}
+	if _, total := search("author:*userb", 0); total != 1 {
+		t.Fatal("author mismatch:", total)
+	}
+	if _, total := search(fmt.Sprintf("in:%d after:2000-01-01", a+1), 0); total != 0 {
+		t.Fatal("in mismatch:", total)
+	}
+	if _, total := search("before:2000-01-01 apple", 0); total != 0 {
+		t.Fatal("before mismatch:", total)
+	}
+
+	q, _ := ParseQuery("ip:1.2. is:deleted")
+	if !q.ModOnly(User{}) || (&Query{Author: users[0]}).ModOnly(User{ID: users[0]}) {
+		t.Fatal("ModOnly mismatch")
+	}
+}
+
+func TestArchiveSearch(t *testing.T) {
+	store, path := newTestStore(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	longID, _ := store.NewTopic("old news", "archived story", nil, [8]byte{'u', 's', 'e', 'r'}, [8]byte{}, false)
+	a, _ := SplitID(longID)
+	store.NewPost(a, "another story", &Image{Path: "x.png"}, [8]byte{}, [8]byte{}, false)
+	store.NewTopic("new news", "live story", nil, [8]byte{}, [8]byte{}, false)
+	if err := store.SetMaxLiveTopics(1); err != nil {
+		t.Fatal(err)
+	}
+
+	search := func(store *Store, text string) []Post {
+		q, err := ParseQuery(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		posts, total := store.Search(q, 0, 10, 1e9)
+		if total != len(posts) {
+			t.Fatal("total mismatch:", text, total)
+		}
+		return posts
+	}
+
+	check := func(store *Store) {
+		if n := store.ArchivedNum(); n != 1 {
+			t.Fatal("archived topics mismatch:", n)
+		}
+		if posts := search(store, "story"); len(posts) != 3 || !posts[1].Topic.Archived || posts[2].Message != "archived story" {
+			t.Fatal("archived posts mismatch:", posts)
+		}
+		if posts := search(store, `"another story" has:image`); len(posts) != 1 || posts[0].ID != 2 {
+			t.Fatal("archived phrase mismatch:", posts)
+		}
+		if posts := search(store, "news author:*user"); len(posts) != 1 || posts[0].Topic.ID != a {
+			t.Fatal("archived author mismatch:", posts)
+		}
+	}
+	check(store)
+	check(openTestStore(t, path))
+
+	os.Remove(store.archiveIndexPath())
+	s := openTestStore(t, path)
+	for i := 0; i < 100 && s.ArchivedNum() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	check(s)
+
+	q, _ := ParseQuery(`"another story"`)
+	if _, total := s.Search(q, 0, 10, 0); total != 0 {
+		t.Fatal("archived topics are loaded after the timeout")
+	}
+}
+
+func TestArchiveBrowser(t *testing.T) {
+	store, path := newTestStore(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	longID, _ := store.NewTopicIn("b", "first", "1", nil, [8]byte{}, [8]byte{}, false)
+	a, _ := SplitID(longID)
+	store.NewPost(a, "2", &Image{Path: "x.png", Name: "x"}, [8]byte{}, [8]byte{}, false)
+	longID, _ = store.NewTopic("second", "1", nil, [8]byte{}, [8]byte{}, false)
+	b, _ := SplitID(longID)
+	store.NewTopic("live", "1", nil, [8]byte{}, [8]byte{}, false)
+	if err := store.SetMaxLiveTopics(1); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(store *Store) {
+		month := time.Now().Format("2006-01")
+		if months := store.ArchiveMonths(); len(months) != 1 || months[0].Month != month || months[0].Count != 2 {
+			t.Fatal("months mismatch:", months)
+		}
+		topics, total := store.ArchivedTopics(month, 0, 10)
+		if total != 2 || len(topics) != 2 || topics[0].ID != b || topics[1].ID != a {
+			t.Fatal("archived topics mismatch:", total, topics)
+		}
+		if x := topics[1]; x.Subject != "first" || x.Board != "b" || x.PostsNum != 2 || x.Image == nil || x.Image.Path != "x.png" {
+			t.Fatal("archived topic mismatch:", x)
+		}
+		if topics[0].ModifiedAt != topics[0].CreatedAt {
+			t.Fatal("modified time mismatch:", topics[0])
+		}
+		if topics, total := store.ArchivedTopics("", 1, 10); total != 2 || len(topics) != 1 || topics[0].ID != a {
+			t.Fatal("archived topics page mismatch:", total, topics)
+		}
+		if _, total := store.ArchivedTopics("2000-01", 0, 10); total != 0 {
+			t.Fatal("archived topics month mismatch:", total)
+		}
+	}
+	check(store)
+	check(openTestStore(t, path))
+}
+
+func TestUnarchiveUnpurge(t *testing.T) {
+	store, path := newTestStore(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	var ids []uint32
+	for _, s := range []string{"first", "second", "third"} {
+		longID, _ := store.NewTopic(s, s+" message", nil, [8]byte{}, [8]byte{}, false)
+		topicID, _ := SplitID(longID)
+		ids = append(ids, topicID)
+	}
+	store.NewPost(ids[0], "reply", nil, [8]byte{}, [8]byte{}, true)
+	store.TagTopic(ids[0], []string{"news"}, true)
+	if err := store.SetMaxLiveTopics(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UnarchiveTopic(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UnarchiveTopic(ids[0]); err == nil {
+		t.Fatal("unarchived a live topic")
+	}
+	if _, err := os.Stat(store.buildArchivePath(ids[0])); !os.IsNotExist(err) || store.ArchivedNum() != 0 {
+		t.Fatal("unarchived topic is still in the archive")
+	}
+
+	store.OperateTopic(ids[1], OP_LOCK)
+	if err := store.OperateTopic(ids[1], OP_PURGE); err != nil {
+		t.Fatal(err)
+	}
+	if trash, _ := store.TrashedTopics(); len(trash) != 1 || trash[0].ID != ids[1] || trash[0].Subject != "second" {
+		t.Fatal("trash mismatch:", trash)
+	}
+	if err := store.UnpurgeTopic(ids[1]); err != nil {
+		t.Fatal(err)
+	}
+	if trash, _ := store.TrashedTopics(); len(trash) != 0 {
+		t.Fatal("unpurged topic is still in the trash:", trash)
+	}
+
+	check := func(store *Store) {
+		if store.LiveTopicsNum != 3 || store.TopicsCount() != 3 {
+			t.Fatal("topics mismatch:", store.LiveTopicsNum, store.TopicsCount())
+		}
+		a := store.GetTopic(ids[0], DefaultTopicMapper)
+		if len(a.Posts) != 2 || a.Posts[1].Message != "reply" || store.TaggedNum("news") != 1 {
+			t.Fatal("unarchived topic mismatch:", a)
+		}
+		if topics := store.GetTopics(0, 1, DefaultTopicFilter, DefaultTopicMapper); topics[0].ID != ids[1] {
+			t.Fatal("unpurged topic is not in the front:", topics[0].ID)
+		}
+		if b := store.GetTopic(ids[1], DefaultTopicMapper); !b.Locked || len(b.Posts) != 1 {
+			t.Fatal("unpurged topic mismatch:", b)
+		}
+		q, _ := ParseQuery("reply")
+		if posts, _ := store.Search(q, 0, 10, 1e9); len(posts) != 1 || posts[0].Topic.Archived {
+			t.Fatal("unarchived topic is not indexed:", posts)
+		}
+	}
+	check(store)
+	check(openTestStore(t, path))
+	SnapshotStore(path+".ss", store)
+	check(openTestStore(t, path+".ss"))
+	if n, _ := Fsck(path, (&ForumConfig{}).SetSalt("test"), "", ioutil.Discard); n != 0 {
+		t.Fatal("broken records:", n)
+	}
+
+	store.OperateTopic(ids[2], OP_PURGE)
+	old := time.Now().Add(-8 * 24 * time.Hour)
+	os.Chtimes(store.trashPath(ids[2]), old, old)
+	if n, err := store.EmptyTrash(7, func(*Image) {}); n != 1 || err != nil {
+		t.Fatal("empty trash:", n, err)
+	}
+	if err := store.UnpurgeTopic(ids[2]); err == nil {
+		t.Fatal("unpurged a removed topic")
+	}
+
+	store.SetReadOnly()
+	if store.OperateTopic(ids[0], OP_PURGE) == nil {
+		t.Fatal("purged a topic in a read-only store")
+	}
+	if _, err := os.Stat(store.trashPath(ids[0])); !os.IsNotExist(err) {
+		t.Fatal("failed purge is in the trash:", err)
+	}
+}
+
+func TestArchivePolicy(t *testing.T) {
+	store, path := newTestStore(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	var ids []uint32
+	for i, board := range []string{"", "", "", "", "b", "b", "", ""} {
+		longID, _ := store.NewTopicIn(board, strconv.Itoa(i), "message", nil, [8]byte{}, [8]byte{}, false)
+		topicID, _ := SplitID(longID)
+		ids = append(ids, topicID)
+	}
+	for _, id := range ids[2:4] {
+		store.topics[id].CreatedAt -= 2 * 86400
+	}
+	store.OperateTopic(ids[3], OP_STICKY)
+	store.maxLiveTopics = 5
+
+	// sticky 3, 7, 6, 5, 4 (b, over the limit), 2 (idle), 1, 0 (over the cap)
+	res, err := store.Archive(ArchivePolicy{IdleDays: 1, BoardLimits: map[string]int{"b": 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ByCount != 1 || res.ByIdle != 1 || res.ByBoard != 1 || store.LastArchive() != res {
+		t.Fatal("archive result mismatch:", res)
+	}
+
+	check := func(store *Store) {
+		if store.LiveTopicsNum != 5 {
+			t.Fatal("live topics mismatch:", store.LiveTopicsNum)
+		}
+		for i, id := range ids {
+			archived := i == 0 || i == 2 || i == 4
+			if (store.topics[id] == nil) != archived {
+				t.Fatal("topic mismatch:", i, archived)
+			}
+		}
+	}
+	check(store)
+	check(openTestStore(t, path))
+}
+
+func TestImageRefs(t *testing.T) {
+	store, path := newTestStore(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	img := func(path string) *Image { return &Image{Path: path, Name: "a.png", Size: 1, X: 1, Y: 1} }
+	store.NewTopic("c", "message", img("z.png"), [8]byte{}, [8]byte{}, false)
+	a, _ := store.NewTopic("a", "message", img("x.png"), [8]byte{}, [8]byte{}, false)
+	topicID, _ := SplitID(a)
+	a2, _ := store.NewPost(topicID, "reply", img("x.png"), [8]byte{}, [8]byte{}, false)
+	b, _ := store.NewTopic("b", "message", img("y.png"), [8]byte{}, [8]byte{}, false)
+
+	waitRefs := func(store *Store) {
+		for store.ImageRefs("") < 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitRefs(store)
+
+	var deleted []string
+	onDelete := func(img *Image) { deleted = append(deleted, img.Path) }
+	mod := User{M: PERM_LOCK_SAGE_DELETE_FLAG}
+	store.DeletePost(mod, a2, false, onDelete)
+	if n := store.ImageRefs("x.png"); n != 1 || len(deleted) != 0 {
+		t.Fatal("refs after deleting:", n, deleted)
+	}
+	store.DeletePost(mod, a2, false, onDelete)
+	if n := store.ImageRefs("x.png"); n != 2 {
+		t.Fatal("refs after undeleting:", n)
+	}
+	store.DeletePost(mod, a, true, onDelete)
+	store.DeletePost(mod, a2, true, onDelete)
+	if n := store.ImageRefs("x.png"); n != 0 || len(deleted) != 1 || deleted[0] != "x.png" {
+		t.Fatal("refs after deleting images:", n, deleted)
+	}
+	if err := store.DeletePost(mod, a, true, onDelete); err == nil {
+		t.Fatal("deleted a missing image")
+	}
+
+	bID, _ := SplitID(b)
+	store.OperateTopic(bID, OP_PURGE)
+	if n := store.ImageRefs("y.png"); n != 1 {
+		t.Fatal("refs after purging:", n)
+	}
+	if err := store.SetMaxLiveTopics(1); err != nil || store.ArchivedNum() != 1 {
+		t.Fatal("archive:", err)
+	}
+
+	check := func(store *Store) {
+		waitRefs(store)
+		if store.ImageRefs("x.png") != 0 || store.ImageRefs("y.png") != 1 || store.ImageRefs("z.png") != 1 {
+			t.Fatal("refs mismatch")
+		}
+		if p, _ := store.getPostPtrUnlocked(a2); p == nil || p.Image != nil {
+			t.Fatal("image of the reply is not deleted")
+		}
+	}
+	check(store)
+	check(openTestStore(t, path))
+
+	old := time.Now().Add(-8 * 24 * time.Hour)
+	os.Chtimes(store.trashPath(bID), old, old)
+	if n, err := store.EmptyTrash(7, onDelete); n != 1 || err != nil || len(deleted) != 2 || deleted[1] != "y.png" {
+		t.Fatal("empty trash:", n, err, deleted)
+	}
+
+	// a held image stays while posts refer to it come and go
+	d, _ := store.NewTopic("d", "message", img("w.png"), [8]byte{}, [8]byte{}, false)
+	release, _ := store.HoldImage("w.png", func() error { return nil })
+	if err := store.DeletePost(mod, d, true, onDelete); err != nil || len(deleted) != 2 {
+		t.Fatal("held image is deleted:", err, deleted)
+	}
+	dID, _ := SplitID(d)
+	store.NewPost(dID, "reply", img("w.png"), [8]byte{}, [8]byte{}, false)
+	release()
+	if n := store.ImageRefs("w.png"); n != 1 {
+		t.Fatal("refs after holding:", n)
+	}
+}
+
+func TestCheckImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fofou")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "upload")
+
+	var rewritten []byte
+	check := func(buf []byte, ext string, maxPixels int) (x, y uint16, err error) {
+		ioutil.WriteFile(path, buf, 0755)
+		x, y, rewritten, err = CheckImage(path, ext, maxPixels)
+		return
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	p := &bytes.Buffer{}
+	png.Encode(p, img)
+	if x, y, err := check(p.Bytes(), ".PNG", 100); x != 3 || y != 2 || err != nil || rewritten != nil {
+		t.Fatal("png:", x, y, err)
+	}
+	if _, _, err := check(p.Bytes(), ".jpg", 100); err != ErrImageFormat {
+		t.Fatal("png as jpg:", err)
+	}
+	if _, _, err := check(p.Bytes(), ".png", 5); err != ErrImageTooLarge {
+		t.Fatal("too many pixels:", err)
+	}
+	if _, _, err := check(p.Bytes()[:len(p.Bytes())-20], ".png", 100); err != ErrImageFormat {
+		t.Fatal("truncated png:", err)
+	}
+
+	// a JPEG with EXIF: big endian, orientation 6 (rotate 90 CW) and a fake GPS IFD pointer
+	j := &bytes.Buffer{}
+	jpeg.Encode(j, img, nil)
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x02" +
+		"\x01\x12\x00\x03\x00\x00\x00\x01\x00\x06\x00\x00" +
+		"\x88\x25\x00\x04\x00\x00\x00\x01\x00\x00\x00\x00" +
+		"\x00\x00\x00\x00")
+	app1 := append([]byte("\xff\xe1\x00\x00Exif\x00\x00"), tiff...)
+	app1[2], app1[3] = byte((len(app1)-2)>>8), byte(len(app1)-2)
+	exif := append(append([]byte{0xff, 0xd8}, app1...), j.Bytes()[2:]...)
+	if exifOrientation(exif) != 6 {
+		t.Fatal("orientation mismatch")
+	}
+	if x, y, err := check(exif, ".jpeg", 100); x != 2 || y != 3 || err != nil {
+		t.Fatal("jpeg:", x, y, err)
+	}
+	if buf, _ := ioutil.ReadFile(path); bytes.Contains(buf, []byte("Exif")) || exifOrientation(buf) != 1 || !bytes.Equal(buf, rewritten) {
+		t.Fatal("EXIF is not stripped")
+	}
+
+	if x, y, err := check([]byte(`<?xml version="1.0"?><svg width="10px" height="20"></svg>`), ".svg", 100); x != 10 || y != 20 || err != nil {
+		t.Fatal("svg:", x, y, err)
+	}
+	if _, _, err := check([]byte(`<html></html>`), ".svg", 100); err != ErrImageFormat {
+		t.Fatal("html as svg:", err)
+	}
+}
+
+func TestThumbnails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fofou")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	size := func(path string) (int, int) {
+		f, err := os.Open(path)
+		if err != nil {
+			return 0, 0
+		}
+		defer f.Close()
+		c, _, _ := image.DecodeConfig(f)
+		return c.Width, c.Height
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	for i := range img.Pix {
+		img.Pix[i] = 0x80
+	}
+	p := &bytes.Buffer{}
+	png.Encode(p, img)
+	path := filepath.Join(dir, "a.png")
+	ioutil.WriteFile(path, p.Bytes(), 0755)
+	if _, err := makeThumbs(path, [2]int{100, 300}); err != nil {
+		t.Fatal(err)
+	}
+	if w, h := size(ThumbFile(path, ThumbSmall)); w != 100 || h != 50 {
+		t.Fatal("small thumbnail:", w, h)
+	}
+	if w, h := size(ThumbFile(path, ThumbMedium)); w != 300 || h != 150 {
+		t.Fatal("medium thumbnail:", w, h)
+	}
+	if thumb := resize(img, 100); thumb.Pix[len(thumb.Pix)/2] != 0x80 {
+		t.Fatal("resampling a flat image changes it:", thumb.Pix[len(thumb.Pix)/2])
+	}
+
+	// the first frame is a red square in the middle of the screen, the second one is all blue
+	pal := color.Palette{color.White, color.RGBA{255, 0, 0, 255}, color.RGBA{0, 0, 255, 255}}
+	f1 := image.NewPaletted(image.Rect(100, 100, 200, 200), pal)
+	f2 := image.NewPaletted(image.Rect(0, 0, 300, 300), pal)
+	for i := range f1.Pix {
+		f1.Pix[i] = 1
+	}
+	for i := range f2.Pix {
+		f2.Pix[i] = 2
+	}
+	g := &bytes.Buffer{}
+	gif.EncodeAll(g, &gif.GIF{Image: []*image.Paletted{f1, f2}, Delay: []int{10, 10}, Config: image.Config{ColorModel: pal, Width: 300, Height: 300}})
+	path = filepath.Join(dir, "a.gif")
+	ioutil.WriteFile(path, g.Bytes(), 0755)
+	if _, err := makeThumbs(path, [2]int{100, 300}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(ThumbFile(path, ThumbMedium)); err == nil {
+		t.Fatal("GIF fits in the medium box")
+	}
+	f, _ := os.Open(ThumbFile(path, ThumbSmall))
+	thumb, err := jpeg.Decode(f)
+	f.Close()
+	if err != nil || thumb.Bounds().Dx() != 100 {
+		t.Fatal("GIF thumbnail:", err)
+	}
+	if r, g, b, _ := thumb.At(50, 50).RGBA(); r>>8 < 200 || g>>8 > 50 || b>>8 > 50 {
+		t.Fatal("GIF thumbnail is not the first frame:", r>>8, g>>8, b>>8)
+	}
+	if r, g, b, _ := thumb.At(5, 5).RGBA(); r>>8 < 200 || g>>8 < 200 || b>>8 < 200 {
+		t.Fatal("GIF thumbnail is not drawn on a white screen:", r>>8, g>>8, b>>8)
+	}
+}
+
+func TestImageQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fofou")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	imageQueueBackoff = 10 * time.Millisecond
+	defer func() { imageQueueBackoff = 10 * time.Second }()
+
+	img := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	p := &bytes.Buffer{}
+	png.Encode(p, img)
+	for _, name := range []string{"a.png", "b.png", "c.jpg.thumb.jpg"} {
+		ioutil.WriteFile(filepath.Join(dir, name), p.Bytes(), 0755)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "bad.png"), []byte("not an image"), 0755)
+
+	logger := NewLogger(16, 16, false, filepath.Join(dir, "log"))
+	journal := filepath.Join(dir, "thumbs.txt")
+	iq := NewImageQueue(logger, 100, 300, 0, journal)
+	if n, err := iq.Backfill(dir); n != 3 || err != nil {
+		t.Fatal("backfill:", n, err)
+	}
+	iq.Push(filepath.Join(dir, "a.png"))
+	if iq.Len() != 3 {
+		t.Fatal("queue length mismatch:", iq.Len())
+	}
+
+	// pending images survive restarts
+	iq = NewImageQueue(logger, 100, 300, 1, journal)
+	for start := time.Now(); iq.Len() > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("queue is stuck:", iq.Stats())
+		}
+	}
+	if _, err := os.Stat(ThumbFile(filepath.Join(dir, "b.png"), ThumbMedium)); err != nil {
+		t.Fatal("thumbnail is not made:", err)
+	}
+	s := iq.Stats()
+	if s.Done != 2 || s.Failed != imageQueueMaxTries || len(s.Dead) != 1 || s.Dead[0].Path != filepath.Join(dir, "bad.png") {
+		t.Fatal("stats mismatch:", s)
+	}
+
+	// images fitting in the medium box are not queued again for it
+	sq := image.NewRGBA(image.Rect(0, 0, 200, 200))
+	p.Reset()
+	png.Encode(p, sq)
+	ioutil.WriteFile(filepath.Join(dir, "sq.png"), p.Bytes(), 0755)
+	iq.Push(filepath.Join(dir, "sq.png"))
+	for start := time.Now(); iq.Len() > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("queue is stuck:", iq.Stats())
+		}
+	}
+	if _, err := os.Stat(ThumbFile(filepath.Join(dir, "sq.png"), ThumbMedium)); err == nil {
+		t.Fatal("image fits in the medium box")
+	}
+	if iq.Push(filepath.Join(dir, "sq.png")); iq.Len() != 0 {
+		t.Fatal("image which needs no more thumbnails is queued again")
+	}
+	if done, err := makeThumbs(filepath.Join(dir, "sq.png"), [2]int{100, 300}); !done || err != nil {
+		t.Fatal("image which needs no more thumbnails is not done:", done, err)
+	}
+
+	iq = NewImageQueue(logger, 100, 300, 0, journal)
+	if s := iq.Stats(); s.Pending != 0 || len(s.Dead) != 1 || s.Dead[0].Error == "" {
+		t.Fatal("dead thumbnails are not saved:", s)
+	}
+	if n := iq.RetryDead(); n != 1 || iq.Len() != 1 || len(iq.Stats().Dead) != 0 {
+		t.Fatal("retry:", n)
+	}
+}
+
+func TestSanitizeSVG(t *testing.T) {
+	svg := `<?xml version="1.0"?>
+<?xml-stylesheet href="http://evil/a.css"?>
+<!DOCTYPE svg>
+<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" width="10" onload="alert(1)">
+	<!-- comment -->
+	<script>alert(1)</script>
+	<style>@import url(http://evil/b.css);</style>
+	<style>.a { fill: url(#g) }</style>
+	<foreignObject><body xmlns="http://www.w3.org/1999/xhtml"><script>alert(1)</script></body></foreignObject>
+	<g xmlns="http://www.w3.org/1999/xhtml"><rect style="fill: url('http://evil/c')" fill="red"/></g>
+	<a xlink:href="javascript:alert(1)"><text x="1" onclick="alert(1)">a &amp; b</text></a>
+	<a href=" java&#x9;script:alert(1)">x</a>
+	<use xlink:href="#g"/>
+	<image href="http://evil/d.png"/>
+	<image href="data:image/png;base64,AAAA"/>
+	<set attributeName="href" to="javascript:alert(1)"/>
+	<animate attributeName="opacity" values="0;1"/>
+	<html:script xmlns:html="http://www.w3.org/1999/xhtml">alert(1)</html:script>
+</svg>`
+	buf, err := SanitizeSVG([]byte(svg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(buf)
+	for _, bad := range []string{"evil", "script", "alert", "onload", "onclick", "foreignObject", "<!", "xhtml"} {
+		if strings.Contains(out, bad) {
+			t.Fatal("unsafe SVG:", bad, out)
+		}
+	}
+	for _, good := range []string{`width="10"`, ".a { fill: url(#g) }", "a &amp; b", `xlink:href="#g"`, "data:image/png", `attributeName="opacity"`, `fill="red"`} {
+		if !strings.Contains(out, good) {
+			t.Fatal("SVG lost:", good, out)
+		}
+	}
+
+	for _, bad := range []string{`<html><svg/></html>`, `<svg><g></svg>`, `<svg/><svg/>`, `not xml`} {
+		if _, err := SanitizeSVG([]byte(bad)); err == nil {
+			t.Fatal("invalid SVG is accepted:", bad)
+		}
+	}
+}
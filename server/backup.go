@@ -0,0 +1,264 @@
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// bytes at the head and before the backed-up offset, used to tell if the data file was rewritten (e.g. compacted)
+const backupDigestSize = 4096
+
+type backupSegment struct {
+	Name      string `json:"name"`
+	Offset    int64  `json:"offset"`
+	Size      int64  `json:"size"`
+	SHA1      string `json:"sha1"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// backupManifest describes a chain of segments, concatenating them gives the data file.
+// When the data file is rewritten, a new chain starts with a full copy.
+type backupManifest struct {
+	Chain    string          `json:"chain"`
+	Digest   string          `json:"digest"`
+	Segments []backupSegment `json:"segments"`
+}
+
+func (m *backupManifest) end() int64 {
+	if len(m.Segments) == 0 {
+		return 0
+	}
+	s := m.Segments[len(m.Segments)-1]
+	return s.Offset + s.Size
+}
+
+func readBackupManifest(dir string) (*backupManifest, error) {
+	m := &backupManifest{}
+	buf, err := ioutil.ReadFile(filepath.Join(dir, "manifest.json"))
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, json.Unmarshal(buf, m)
+}
+
+func (m *backupManifest) write(dir string) error {
+	buf, _ := json.MarshalIndent(m, "", "  ")
+	path := filepath.Join(dir, "manifest.json")
+	if err := ioutil.WriteFile(path+".tmp", buf, 0755); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func digest(f io.ReaderAt, end int64) (string, error) {
+	head, tail := end, end-backupDigestSize
+	if head > 16+backupDigestSize {
+		head = 16 + backupDigestSize
+	}
+	if tail < head {
+		tail = head
+	}
+	h := sha1.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, 16, head-16)); err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(h, io.NewSectionReader(f, tail, end-tail)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Backup copies bytes appended since the last backup into a new segment in dir,
+// the store lock is only held to read the committed size. It returns the number of bytes copied.
+func (store *Store) Backup(dir string) (int64, error) {
+	store.backupLock.Lock()
+	defer store.backupLock.Unlock()
+
+	store.RLock()
+	f, end := store.dataFile, store.ptr
+	store.RUnlock()
+
+	if f == nil {
+		return 0, fmt.Errorf("store not ready")
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+
+	m, err := readBackupManifest(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	// bytes before ptr never change, so they can be copied while others append,
+	// if Compact swaps the file in the middle, the read fails and the next run will retry
+	start := m.end()
+	if start > 0 {
+		d, err := digest(f, start)
+		if err != nil {
+			return 0, err
+		}
+		if start > end || d != m.Digest {
+			start = 0
+		}
+	}
+	if start == end {
+		return 0, nil
+	}
+
+	old := m
+	if start == 0 {
+		m = &backupManifest{Chain: fmt.Sprintf("%x", time.Now().UnixNano())}
+	}
+
+	seg := backupSegment{
+		Name:      fmt.Sprintf("%s.%06d", m.Chain, len(m.Segments)),
+		Offset:    start,
+		Size:      end - start,
+		CreatedAt: time.Now().Unix(),
+	}
+
+	of, err := os.Create(filepath.Join(dir, seg.Name))
+	if err != nil {
+		return 0, err
+	}
+	defer of.Close()
+
+	h := sha1.New()
+	if _, err := io.Copy(io.MultiWriter(of, h), io.NewSectionReader(f, start, seg.Size)); err != nil {
+		return 0, err
+	}
+	if err := of.Sync(); err != nil {
+		return 0, err
+	}
+
+	seg.SHA1 = hex.EncodeToString(h.Sum(nil))
+	if m.Digest, err = digest(f, end); err != nil {
+		return 0, err
+	}
+	m.Segments = append(m.Segments, seg)
+	if err := m.write(dir); err != nil {
+		return 0, err
+	}
+
+	if old != m {
+		// the new chain is complete, old segments are no longer needed
+		for _, s := range old.Segments {
+			os.Remove(filepath.Join(dir, s.Name))
+		}
+	}
+	return seg.Size, nil
+}
+
+// Export writes a consistent copy of the data file into w without holding the store lock
+func (store *Store) Export(w io.Writer) (int64, error) {
+	store.RLock()
+	f, end, utf8 := store.dataFile, store.ptr, store.utf8
+	store.RUnlock()
+
+	if f == nil {
+		return 0, fmt.Errorf("store not ready")
+	}
+
+	var hdr buffer
+	hdr.WriteByte('z').WriteByte('z').WriteByte('z')
+	if utf8 {
+		hdr.WriteByte(HEADER_UTF8)
+	} else {
+		hdr.WriteByte(0)
+	}
+	hdr.WriteUInt48(uint64(end)).WriteUInt48(0)
+	if _, err := w.Write(hdr.Bytes()); err != nil {
+		return 0, err
+	}
+
+	n, err := io.Copy(w, io.NewSectionReader(f, 16, end-16))
+	return n + 16, err
+}
+
+// ExportFile writes the copy made by Export into path, which is replaced only if the copy is complete
+func (store *Store) ExportFile(path string) (int64, error) {
+	of, err := os.Create(path + ".tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(path + ".tmp")
+
+	n, err := store.Export(of)
+	if err == nil {
+		err = of.Sync()
+	}
+	if err1 := of.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return 0, err
+	}
+	return n, os.Rename(path+".tmp", path)
+}
+
+// RestoreBackup concatenates segments in dir into output, verifies their hashes and
+// replays the result. It returns the size of the restored data file.
+func RestoreBackup(dir, output string, password [16]byte) (int64, error) {
+	m, err := readBackupManifest(dir)
+	if err != nil {
+		return 0, err
+	}
+	if len(m.Segments) == 0 {
+		return 0, fmt.Errorf("no backup found in %s", dir)
+	}
+
+	of, err := os.Create(output)
+	if err != nil {
+		return 0, err
+	}
+	defer of.Close()
+
+	var size int64
+	for _, s := range m.Segments {
+		if s.Offset != size || !strings.HasPrefix(s.Name, m.Chain+".") {
+			return 0, fmt.Errorf("segment %s: not in chain %s at 0x%08x", s.Name, m.Chain, size)
+		}
+
+		f, err := os.Open(filepath.Join(dir, s.Name))
+		if err != nil {
+			return 0, err
+		}
+
+		h := sha1.New()
+		n, err := io.Copy(io.MultiWriter(of, h), f)
+		f.Close()
+		if err != nil {
+			return 0, err
+		}
+		if n != s.Size || hex.EncodeToString(h.Sum(nil)) != s.SHA1 {
+			return 0, fmt.Errorf("segment %s: size or hash mismatch", s.Name)
+		}
+		size += n
+	}
+
+	// the header in the first segment may be stale
+	if err := commitHeader(of, size); err != nil {
+		return 0, err
+	}
+	if err := of.Sync(); err != nil {
+		return 0, err
+	}
+
+	if err := newDummyStore(password).loadDB(output, true, nil); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
@@ -2,16 +2,21 @@ package server
 
 import (
 	"bytes"
+	"encoding/binary"
 	"io"
+	"strings"
 	"unicode/utf8"
 )
 
+const maxStringLen = 1 << 24
+
 type buffer struct {
 	p      bytes.Buffer
 	r      io.Reader
 	pos    int64
 	postmp int64
 	one    [1]byte
+	utf8   bool // strings are stored in the HEADER_UTF8 format
 }
 
 func (b *buffer) Bytes() []byte {
@@ -69,6 +74,12 @@ func (b *buffer) WriteUInt48(v uint64) *buffer {
 	return b
 }
 
+func (b *buffer) WriteUInt64(v uint64) *buffer {
+	b.WriteUInt32(uint32(v >> 32))
+	b.WriteUInt32(uint32(v))
+	return b
+}
+
 func (b *buffer) WriteUInt32(v uint32) *buffer {
 	b.p.WriteByte(byte(v >> 24))
 	b.p.WriteByte(byte(v >> 16))
@@ -107,6 +118,15 @@ func (b *buffer) Read8Bytes() (res [8]byte, err error) {
 	return
 }
 
+func (b *buffer) ReadUInt64() (uint64, error) {
+	v0, err := b.ReadUInt32()
+	v1, err := b.ReadUInt32()
+	if err != nil {
+		return 0, err
+	}
+	return uint64(v0)<<32 + uint64(v1), nil
+}
+
 func (b *buffer) ReadUInt32() (uint32, error) {
 	v0, err := b.ReadByte()
 	v1, err := b.ReadByte()
@@ -127,8 +147,13 @@ func (b *buffer) ReadUInt16() (uint16, error) {
 	return uint16(v0)<<8 + uint16(v1), nil
 }
 
-// Plane 0 only
+// WriteString writes the legacy format (plane 0 only) or the UTF-8 format
+// depending on b.utf8
 func (b *buffer) WriteString(str string) *buffer {
+	if b.utf8 {
+		return b.writeStringUTF8(str)
+	}
+
 	queue := make([]byte, 0, 256)
 
 	appendQueue := func() {
@@ -165,7 +190,57 @@ func (b *buffer) WriteString(str string) *buffer {
 	return b
 }
 
+// writeStringUTF8 writes: uvarint(length) | utf-8 bytes | crc8
+func (b *buffer) writeStringUTF8(str string) *buffer {
+	str = strings.ToValidUTF8(str, string(utf8.RuneError))
+
+	tmp := [binary.MaxVarintLen64]byte{}
+	b.p.Write(tmp[:binary.PutUvarint(tmp[:], uint64(len(str)))])
+	b.p.WriteString(str)
+
+	h := byte(0)
+	for i := 0; i < len(str); i++ {
+		h = crc8(h, str[i])
+	}
+	b.p.WriteByte(h)
+	return b
+}
+
+func (b *buffer) readStringUTF8() (string, error) {
+	b.postmp = b.pos
+	ln, err := binary.ReadUvarint(b)
+	if err != nil {
+		return "", err
+	}
+	if ln > maxStringLen {
+		return "", errInvalidHash
+	}
+
+	str, h := make([]byte, ln), byte(0)
+	for i := range str {
+		if str[i], err = b.ReadByte(); err != nil {
+			return "", err
+		}
+		h = crc8(h, str[i])
+	}
+
+	h2, err := b.ReadByte()
+	if err != nil {
+		return "", err
+	}
+
+	if h != h2 || !utf8.Valid(str) {
+		return "", errInvalidHash
+	}
+
+	return string(str), nil
+}
+
 func (b *buffer) ReadString() (string, error) {
+	if b.utf8 {
+		return b.readStringUTF8()
+	}
+
 	str := make([]byte, 0)
 	enc := make([]byte, 3)
 	h := byte(0)
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// DumpFilter selects ops to be dumped, zero values match everything
+type DumpFilter struct {
+	Topic uint32
+	Ops   []byte
+	From  int64
+	To    int64 // exclusive
+}
+
+// ParseOpNames converts names like "POST,LOCK" into opcodes
+func ParseOpNames(names string) ([]byte, error) {
+	ops := []byte{}
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.ToUpper(strings.TrimSpace(name)); name == "" {
+			continue
+		}
+		found := false
+		for op, n := range opNames {
+			if n == name {
+				ops = append(ops, op)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown op: %s", name)
+		}
+	}
+	return ops, nil
+}
+
+func (f *DumpFilter) match(pos int64, op byte, res opResult) bool {
+	if pos < f.From {
+		return false
+	}
+	if f.Topic > 0 && (res.topic == nil || res.topic.ID != f.Topic) {
+		if from, _ := SplitID(res.from); res.from == 0 || from != f.Topic {
+			return false
+		}
+	}
+	if len(f.Ops) > 0 && strings.IndexByte(string(f.Ops), op) == -1 {
+		return false
+	}
+	return true
+}
+
+type dumpLine struct {
+	Offset    int64  `json:"offset"`
+	Op        string `json:"op"`
+	Topic     uint32 `json:"topic,omitempty"`
+	Post      uint16 `json:"post,omitempty"`
+	LongID    uint64 `json:"longid,omitempty"`
+	CreatedAt uint32 `json:"created_at,omitempty"`
+	Time      string `json:"time,omitempty"`
+	Subject   string `json:"subject,omitempty"`
+	Message   string `json:"message,omitempty"`
+	IP        string `json:"ip,omitempty"`
+	User      string `json:"user,omitempty"`
+	Image     *Image `json:"image,omitempty"`
+	Status    byte   `json:"status,omitempty"`
+	State     *bool  `json:"state,omitempty"`
+	Value     string `json:"value,omitempty"`
+	From      uint64 `json:"from,omitempty"`
+	Num       uint32 `json:"num,omitempty"`
+}
+
+func newDumpLine(pos int64, op byte, res opResult) *dumpLine {
+	l := &dumpLine{Offset: pos, Op: opNames[op], Num: res.num, From: res.from}
+	if op == OP_TIME {
+		l.Time = time.Unix(int64(res.num), 0).Format(time.RFC3339)
+	}
+
+	if t := res.topic; t != nil {
+		l.Topic = t.ID
+		v := false
+		switch op {
+		case OP_TOPIC, OP_UNARCHIVE, OP_UNPURGE:
+			l.Subject = t.Subject
+		case OP_STICKY:
+			v, l.State = t.Sticky, &v
+		case OP_LOCK:
+			v, l.State = t.Locked, &v
+		case OP_FREEREPLY:
+			v, l.State = t.FreeReply, &v
+		case OP_SAGE:
+			v, l.State = t.Saged, &v
+		}
+	}
+
+	if p := res.post; p != nil {
+		l.Post, l.LongID = p.ID, p.LongID()
+		switch op {
+		case OP_POST:
+			l.CreatedAt = p.CreatedAt
+			l.Time = time.Unix(int64(p.CreatedAt), 0).Format(time.RFC3339)
+			l.Message = p.Message
+			l.IP, l.User = p.IP(), p.User()
+			l.Image = p.Image
+			l.Status = p.Status
+		case OP_APPEND:
+			l.Message = res.str
+		case OP_EDIT:
+			l.CreatedAt = p.EditedAt
+			l.Time = time.Unix(int64(p.EditedAt), 0).Format(time.RFC3339)
+			l.Message = res.str
+		case OP_IMAGE:
+			l.Image = p.Image
+		case OP_DELIMAGE:
+			l.Value = res.str
+		case OP_DELETE:
+			v := p.IsDeleted()
+			l.State = &v
+		case OP_NSFW:
+			v := p.T_Status&POST_T_ISNSFW > 0
+			l.State = &v
+		}
+	}
+
+	switch op {
+	case OP_BLOCK:
+		l.IP, l.User = Format8Bytes(res.term)
+	case OP_CONFIG, OP_BOARD, OP_TAG, OP_UNTAG:
+		l.Value = res.str
+	case OP_REDIRECT:
+		l.LongID = res.num64
+	}
+	return l
+}
+
+// DumpLog replays the data file or an archived topic and writes each op as a line of JSON into w,
+// IPs and users are decrypted with password.
+func DumpLog(path string, password [16]byte, filter DumpFilter, w io.Writer) error {
+	store := newDummyStore(password)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+
+	var err error
+	store.onReplay = func(pos int64, op byte, res opResult) bool {
+		if filter.To > 0 && pos >= filter.To {
+			return false
+		}
+		if filter.match(pos, op, res) {
+			err = enc.Encode(newDumpLine(pos, op, res))
+		}
+		return err == nil
+	}
+
+	if e := store.loadDB(path, true, nil); e != nil {
+		return e
+	}
+	return err
+}
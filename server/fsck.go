@@ -0,0 +1,264 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ops protected by string hashes, a resync after corrupted data only stops at them
+const fsckAnchors = string(OP_TOPIC) + string(OP_POST) + string(OP_APPEND) + string(OP_IMAGE) + string(OP_CONFIG) + string(OP_EDIT)
+
+type fsckBlock struct {
+	start  int64
+	end    int64
+	reason string
+}
+
+// Fsck replays the data file and all archived topics next to it op by op,
+// every record which can't be replayed is reported to w with its offset and the reason.
+// mode can be:
+//   ""          only report
+//   "truncate"  cut the file at the first bad record
+//   "skip"      remove bad records and keep the rest
+// Removed bytes are always saved into *.quarantine. It returns the number of bad records.
+func Fsck(path string, password [16]byte, mode string, w io.Writer) (int, error) {
+	if mode != "" && mode != "truncate" && mode != "skip" {
+		return 0, fmt.Errorf("unknown repair mode: %s", mode)
+	}
+
+	n, err := fsckFileRepeat(path, password, mode, w)
+	if err != nil {
+		return n, err
+	}
+
+	err = filepath.Walk(filepath.Join(filepath.Dir(path), "archive"), func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		if _, err := strconv.Atoi(info.Name()); err != nil {
+			// not an archived topic
+			return nil
+		}
+		x, err := fsckFileRepeat(p, password, mode, w)
+		n += x
+		return err
+	})
+	return n, err
+}
+
+// fsckFileRepeat checks the file again after skipping bad records, because later records may depend on them
+func fsckFileRepeat(path string, password [16]byte, mode string, w io.Writer) (int, error) {
+	n := 0
+	for i := 0; i < 8; i++ {
+		x, err := fsckFile(path, password, mode, w)
+		if n += x; err != nil || x == 0 || mode != "skip" {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func fsckFile(path string, password [16]byte, mode string, w io.Writer) (int, error) {
+	flag := os.O_RDONLY
+	if mode != "" {
+		flag = os.O_RDWR
+	}
+
+	f, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	report := func(pos int64, f string, args ...interface{}) {
+		fmt.Fprintf(w, "%s: 0x%08x: %s\n", path, pos, fmt.Sprintf(f, args...))
+	}
+
+	size, hdr, err := readHeader(f)
+	if err != nil || size < 16 {
+		// the header can't be trusted, there is nothing to replay against
+		report(0, "invalid header")
+		return 1, nil
+	}
+
+	var bad []fsckBlock
+	var short bool
+	if size > fi.Size() {
+		report(size, "committed size is beyond the end of file (0x%08x)", fi.Size())
+		size, short = fi.Size(), true
+	} else if size < fi.Size() {
+		report(size, "%d uncommitted bytes, ignored", fi.Size()-size)
+	}
+
+	store := newDummyStore(password)
+	store.utf8 = hdr&HEADER_UTF8 > 0
+
+	reader := func(pos int64, bufSize int) *buffer {
+		r := &buffer{utf8: store.utf8}
+		r.SetReader(bufio.NewReaderSize(io.NewSectionReader(f, pos, size-pos), bufSize))
+		r.pos = pos
+		return r
+	}
+
+	topicOps := map[uint32]fsckBlock{}
+	for r := reader(16, 1024*1024); r.pos < size; {
+		start := r.pos
+		op, err := store.fsckOp(r, "")
+		if err == nil {
+			if op == OP_TOPIC {
+				id := [4]byte{}
+				f.ReadAt(id[:], start+1)
+				topicOps[uint32(id[0])<<24+uint32(id[1])<<16+uint32(id[2])<<8+uint32(id[3])] = fsckBlock{start: start, end: r.pos}
+			}
+			continue
+		}
+
+		b := fsckBlock{start: start, end: size, reason: err.Error()}
+		for c := start + 1; c < size; c++ {
+			r = reader(c, 4096)
+			if _, err := store.fsckOp(r, fsckAnchors); err == nil {
+				b.end = c
+				r = reader(r.pos, 1024*1024)
+				break
+			}
+		}
+
+		report(b.start, "%s, %d bytes skipped", b.reason, b.end-b.start)
+		bad = append(bad, b)
+		if b.end == size {
+			break
+		}
+	}
+
+	for id, b := range topicOps {
+		if t := store.topics[id]; t != nil && len(t.Posts) == 0 {
+			b.reason = fmt.Sprintf("topic %d has no posts", id)
+			report(b.start, "%s", b.reason)
+			bad = append(bad, b)
+		}
+	}
+	sort.Slice(bad, func(i, j int) bool { return bad[i].start < bad[j].start })
+
+	if short && (len(bad) == 0 || bad[len(bad)-1].end < size) {
+		bad = append(bad, fsckBlock{start: size, end: size, reason: "size beyond EOF"})
+	}
+
+	if err := store.GetConfig(&map[string]interface{}{}); err != nil {
+		report(size, "invalid config: %v", err)
+	}
+
+	if len(bad) == 0 || mode == "" {
+		return len(bad), nil
+	}
+
+	if mode == "truncate" {
+		bad = []fsckBlock{{start: bad[0].start, end: size, reason: bad[0].reason}}
+	}
+
+	if err := fsckQuarantine(f, path, bad); err != nil {
+		return len(bad), err
+	}
+
+	switch mode {
+	case "truncate":
+		if err := commitHeader(f, bad[0].start); err != nil {
+			return len(bad), err
+		}
+		if err := f.Truncate(bad[0].start); err != nil {
+			return len(bad), err
+		}
+		report(bad[0].start, "truncated")
+	case "skip":
+		if err := fsckSkip(f, path, size, bad); err != nil {
+			return len(bad), err
+		}
+		report(0, "rewritten, the original file is saved as %s.bak", path)
+	}
+	return len(bad), nil
+}
+
+func (store *Store) fsckOp(r *buffer, anchors string) (op byte, err error) {
+	defer func() {
+		if x := recover(); x != nil {
+			err = fmt.Errorf("%v", x)
+		}
+	}()
+
+	if op, err = r.ReadByte(); err != nil {
+		return
+	}
+	if anchors != "" && strings.IndexByte(anchors, op) == -1 {
+		return op, fmt.Errorf("not an anchor")
+	}
+
+	store.applyOp(op, r, func(string, ...interface{}) {})
+	return
+}
+
+func fsckQuarantine(f *os.File, path string, bad []fsckBlock) error {
+	q, err := os.OpenFile(path+".quarantine", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+
+	for _, b := range bad {
+		if _, err := fmt.Fprintf(q, "# %s 0x%08x %d %s\n", path, b.start, b.end-b.start, b.reason); err != nil {
+			return err
+		}
+		if _, err := io.Copy(q, io.NewSectionReader(f, b.start, b.end-b.start)); err != nil {
+			return err
+		}
+		if _, err := q.Write([]byte("\n")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fsckSkip(f *os.File, path string, size int64, bad []fsckBlock) error {
+	tmp := path + ".fsck"
+	of, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	defer of.Close()
+
+	if _, err := io.Copy(of, io.NewSectionReader(f, 0, 16)); err != nil {
+		return err
+	}
+
+	start := int64(16)
+	for _, b := range append(bad, fsckBlock{start: size, end: size}) {
+		if _, err := io.Copy(of, io.NewSectionReader(f, start, b.start-start)); err != nil {
+			return err
+		}
+		start = b.end
+	}
+
+	n, err := of.Seek(0, 1)
+	if err != nil {
+		return err
+	}
+	if err := commitHeader(of, n); err != nil {
+		return err
+	}
+	if err := of.Sync(); err != nil {
+		return err
+	}
+	if err := os.Rename(path, path+".bak"); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
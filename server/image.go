@@ -1,104 +1,525 @@
 package server
 
 import (
+	"bytes"
 	"image"
+	"image/draw"
 	"image/gif"
 	"image/jpeg"
 	_ "image/png"
+	"io/ioutil"
 	"math"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
+// thumbnail sizes, ?thumb=1 and ?thumb=2 in /i/
+const (
+	ThumbSmall  = 1 // posts and lists
+	ThumbMedium = 2 // the images browser
+)
+
+// ThumbFile returns the thumbnail file of the image file, small ones are named as older versions did
+func ThumbFile(path string, size int) string {
+	if size == ThumbMedium {
+		return path + ".thumb2.jpg"
+	}
+	return path + ".thumb.jpg"
+}
+
+// ImageQueueStats is shown on the /mod page
+type ImageQueueStats struct {
+	Pending   int // including retrying ones
+	Retrying  int
+	Done      int
+	Failed    int // failed attempts
+	PerMinute int // done in the last minute
+	Last      time.Duration
+	Max       time.Duration
+	Average   time.Duration
+	Dead      []DeadThumb
+}
+
+// DeadThumb is an image which failed imageQueueMaxTries times, it stays until retried by RetryDead
+type DeadThumb struct {
+	Path  string
+	Error string
+	Tries int
+}
+
+const imageQueueMaxTries = 5
+
+var imageQueueBackoff = 10 * time.Second // doubled after each try
+
+type thumbJob struct {
+	path  string
+	tries int
+	due   time.Time // when to retry
+}
+
+// ImageQueue makes thumbnails in the background. Queued paths are journaled so they are queued again
+// after a restart: "+PATH" when queued, "-PATH" when done and "!PATH\tERROR" when dead,
+// the journal is rewritten on start and whenever the queue is empty.
 type ImageQueue struct {
-	q       chan string
-	sizeBox int
 	*Logger
+	boxes   [2]int // small and medium
+	backoff time.Duration
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   []*thumbJob
+	pending map[string]*thumbJob // queued or being made
+	done    map[string]bool      // images which need no more thumbnails
+	dead    []DeadThumb
+	journal *os.File // nil if not persistent
+	jpath   string
+
+	stats  ImageQueueStats
+	total  time.Duration
+	recent []time.Time // times of jobs done in the last minute
 }
 
-func NewImageQueue(l *Logger, sizeBox int, workers int) *ImageQueue {
+// NewImageQueue starts workers making thumbnails, journal is where queued paths are saved, empty to save nothing
+func NewImageQueue(l *Logger, small, medium int, workers int, journal string) *ImageQueue {
 	iq := &ImageQueue{
-		q:       make(chan string, 256),
 		Logger:  l,
-		sizeBox: sizeBox,
+		boxes:   [2]int{small, medium},
+		backoff: imageQueueBackoff,
+		pending: map[string]*thumbJob{},
+		done:    map[string]bool{},
+		jpath:   journal,
+	}
+	iq.cond = sync.NewCond(&iq.mu)
+
+	if journal != "" {
+		iq.loadJournal()
 	}
 
 	for i := 0; i < workers; i++ {
 		go iq.job()
 	}
+	go func() {
+		// wake up workers waiting for retries
+		for range time.Tick(iq.backoff / 10) {
+			iq.cond.Broadcast()
+		}
+	}()
 	return iq
 }
 
+func (iq *ImageQueue) loadJournal() {
+	buf, err := ioutil.ReadFile(iq.jpath)
+	if err != nil && !os.IsNotExist(err) {
+		iq.Error("thumbnail queue: %v", err)
+	}
+
+	var order []string
+	dead := map[string]DeadThumb{}
+	for _, line := range strings.Split(string(buf), "\n") {
+		if len(line) < 2 {
+			continue
+		}
+		path := line[1:]
+		switch line[0] {
+		case '+':
+			if iq.pending[path] == nil {
+				iq.pending[path] = &thumbJob{path: path}
+				order = append(order, path)
+			}
+			delete(dead, path)
+		case '-':
+			delete(iq.pending, path)
+		case '!':
+			d := DeadThumb{Path: path, Tries: imageQueueMaxTries}
+			if idx := strings.Index(path, "\t"); idx > -1 {
+				d.Path, d.Error = path[:idx], path[idx+1:]
+			}
+			delete(iq.pending, d.Path)
+			dead[d.Path] = d
+		}
+	}
+	for _, path := range order {
+		if j := iq.pending[path]; j != nil {
+			iq.queue = append(iq.queue, j)
+		}
+	}
+	for _, d := range dead {
+		iq.dead = append(iq.dead, d)
+	}
+	sort.Slice(iq.dead, func(i, j int) bool { return iq.dead[i].Path < iq.dead[j].Path })
+	iq.rewriteJournal()
+}
+
+// rewriteJournal saves what is pending or dead, the caller should hold the lock
+func (iq *ImageQueue) rewriteJournal() {
+	if iq.jpath == "" {
+		return
+	}
+	if iq.journal != nil {
+		iq.journal.Close()
+	}
+
+	buf := bytes.Buffer{}
+	for _, j := range iq.pending {
+		buf.WriteString("+" + j.path + "\n")
+	}
+	for _, d := range iq.dead {
+		buf.WriteString("!" + d.Path + "\t" + d.Error + "\n")
+	}
+
+	var err error
+	if err = ioutil.WriteFile(iq.jpath+".tmp", buf.Bytes(), 0644); err == nil {
+		err = os.Rename(iq.jpath+".tmp", iq.jpath)
+	}
+	if err == nil {
+		iq.journal, err = os.OpenFile(iq.jpath, os.O_WRONLY|os.O_APPEND, 0644)
+	}
+	if err != nil {
+		iq.journal = nil
+		iq.Error("thumbnail queue: %v", err)
+	}
+}
+
+// log appends a line to the journal, the caller should hold the lock
+func (iq *ImageQueue) log(line string) {
+	if iq.journal == nil {
+		return
+	}
+	if _, err := iq.journal.WriteString(line + "\n"); err != nil {
+		iq.Error("thumbnail queue: %v", err)
+	}
+}
+
 func (iq *ImageQueue) Len() int {
-	return len(iq.q)
+	iq.mu.Lock()
+	defer iq.mu.Unlock()
+	return len(iq.pending)
 }
 
+func (iq *ImageQueue) Stats() ImageQueueStats {
+	iq.mu.Lock()
+	defer iq.mu.Unlock()
+
+	s := iq.stats
+	s.Pending, s.Retrying = len(iq.pending), 0
+	for _, j := range iq.queue {
+		if j.tries > 0 {
+			s.Retrying++
+		}
+	}
+	for len(iq.recent) > 0 && time.Since(iq.recent[0]) > time.Minute {
+		iq.recent = iq.recent[1:]
+	}
+	s.PerMinute = len(iq.recent)
+	s.Dead = append([]DeadThumb{}, iq.dead...)
+	return s
+}
+
+// Push queues the image, images already queued or known to need no thumbnails are ignored
 func (iq *ImageQueue) Push(path string) {
-	select {
-	case iq.q <- path:
-	default:
+	iq.mu.Lock()
+	defer iq.mu.Unlock()
+	iq.push(path)
+}
+
+func (iq *ImageQueue) push(path string) bool {
+	if iq.pending[path] != nil || iq.done[path] {
+		return false
+	}
+	j := &thumbJob{path: path}
+	iq.pending[path] = j
+	iq.queue = append(iq.queue, j)
+	iq.log("+" + path)
+	iq.cond.Signal()
+	return true
+}
+
+// RetryDead queues dead images again, it returns the number of them
+func (iq *ImageQueue) RetryDead() int {
+	iq.mu.Lock()
+	defer iq.mu.Unlock()
+
+	n := 0
+	for _, d := range iq.dead {
+		if iq.push(d.Path) {
+			n++
+		}
+	}
+	iq.dead = nil
+	iq.rewriteJournal()
+	return n
+}
+
+// Backfill queues every image in dir without a small thumbnail, it returns the number of them
+func (iq *ImageQueue) Backfill(dir string) (int, error) {
+	var paths []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		if path == ThumbFile(strings.TrimSuffix(path, ".thumb.jpg"), ThumbSmall) ||
+			path == ThumbFile(strings.TrimSuffix(path, ".thumb2.jpg"), ThumbMedium) {
+			return nil
+		}
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".png", ".jpg", ".jpeg", ".gif":
+			if _, err := os.Stat(ThumbFile(path, ThumbSmall)); err != nil {
+				paths = append(paths, path)
+			}
+		}
+		return nil
+	})
+
+	iq.mu.Lock()
+	defer iq.mu.Unlock()
+	n := 0
+	for _, path := range paths {
+		if iq.push(path) {
+			n++
+		}
+	}
+	return n, err
+}
+
+// next waits for a job which is due
+func (iq *ImageQueue) next() *thumbJob {
+	iq.mu.Lock()
+	defer iq.mu.Unlock()
+	for {
+		now := time.Now()
+		for i, j := range iq.queue {
+			if !j.due.After(now) {
+				iq.queue = append(iq.queue[:i], iq.queue[i+1:]...)
+				return j
+			}
+		}
+		iq.cond.Wait()
 	}
 }
 
 func (iq *ImageQueue) job() {
 	for {
-		select {
-		case path := <-iq.q:
-			err := naiveDownscale(path, iq.sizeBox)
-			if err != nil {
-				iq.Error("downscale %s: %v", path, err)
+		j := iq.next()
+		start := time.Now()
+		done, err := makeThumbs(j.path, iq.boxes)
+		d := time.Since(start)
+
+		iq.mu.Lock()
+		if iq.stats.Last = d; d > iq.stats.Max {
+			iq.stats.Max = d
+		}
+
+		if err != nil {
+			iq.stats.Failed++
+			if j.tries++; j.tries < imageQueueMaxTries {
+				j.due = time.Now().Add(iq.backoff << uint(j.tries-1))
+				iq.queue = append(iq.queue, j)
+				iq.Error("thumbnail %s (try %d): %v", j.path, j.tries, err)
+			} else {
+				delete(iq.pending, j.path)
+				iq.dead = append(iq.dead, DeadThumb{Path: j.path, Error: err.Error(), Tries: j.tries})
+				iq.log("!" + j.path + "\t" + strings.Replace(err.Error(), "\n", " ", -1))
+				iq.Error("thumbnail %s is dead after %d tries: %v", j.path, j.tries, err)
+			}
+		} else {
+			delete(iq.pending, j.path)
+			iq.stats.Done++
+			iq.total += d
+			iq.stats.Average = iq.total / time.Duration(iq.stats.Done)
+			iq.recent = append(iq.recent, time.Now())
+			if done {
+				if len(iq.done) > 65536 {
+					iq.done = map[string]bool{}
+				}
+				iq.done[j.path] = true
 			}
+			iq.log("-" + j.path)
 		}
-		time.Sleep(500 * time.Millisecond)
+
+		if len(iq.pending) == 0 {
+			iq.rewriteJournal()
+		}
+		iq.mu.Unlock()
 	}
 }
 
-func naiveDownscale(path string, sizeBox int) error {
-	if _, err := os.Stat(path + ".thumb.jpg"); err == nil {
-		return nil
+// makeThumbs writes thumbnails of the image in each box, images already fit in a box don't have one,
+// done is true if no box needs a thumbnail any more. GIFs are always thumbnailed by their first frames.
+func makeThumbs(path string, boxes [2]int) (done bool, err error) {
+	todo := false
+	for i := range boxes {
+		if _, err := os.Stat(ThumbFile(path, i+1)); err != nil {
+			todo = true
+		}
+	}
+	if !todo {
+		return true, nil
 	}
 
-	if _, err := os.Stat(path); err != nil {
-		return nil
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return false, err
 	}
 
-	f, err := os.Open(path)
+	config, _, err := image.DecodeConfig(bytes.NewReader(buf))
 	if err != nil {
-		return err
+		return false, err
+	}
+	// only decode the image if a box missing its thumbnail is smaller than it
+	todo = false
+	for i, box := range boxes {
+		if _, err := os.Stat(ThumbFile(path, i+1)); err != nil && (config.Width > box || config.Height > box) {
+			todo = true
+		}
+	}
+	if !todo {
+		return true, nil
 	}
-	defer f.Close()
 
 	var img image.Image
 	if strings.HasSuffix(path, ".gif") {
-		img, err = gif.Decode(f)
+		// the first frame is drawn onto the logical screen, gif.Decode doesn't decode other frames
+		img, err = gif.Decode(bytes.NewReader(buf))
+		if err == nil {
+			screen := image.NewRGBA(image.Rect(0, 0, config.Width, config.Height))
+			draw.Draw(screen, screen.Bounds(), image.White, image.ZP, draw.Src)
+			draw.Draw(screen, img.Bounds(), img, img.Bounds().Min, draw.Over)
+			img = screen
+		}
 	} else {
-		img, _, err = image.Decode(f)
+		img, _, err = image.Decode(bytes.NewReader(buf))
 	}
 	if err != nil {
-		return err
+		return false, err
 	}
 
+	// JPEGs have no alpha, transparent pixels become white
 	b := img.Bounds()
-	if b.Dx() <= sizeBox && b.Dy() <= sizeBox {
-		return nil
-	}
+	src := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), image.White, image.ZP, draw.Src)
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Over)
 
-	w, h := float64(b.Dx()), float64(b.Dy())
-	k := math.Max(w, h) / float64(sizeBox)
-
-	canvas := image.NewRGBA(image.Rect(0, 0, int(w/k), int(h/k)))
-	for x := 0.0; x < w/k; x++ {
-		for y := 0.0; y < h/k; y++ {
-			canvas.Set(int(x), int(y), img.At(int(x*k), int(y*k)))
+	for i, box := range boxes {
+		thumb := ThumbFile(path, i+1)
+		if _, err := os.Stat(thumb); err == nil || (b.Dx() <= box && b.Dy() <= box) {
+			continue
+		}
+		if err := writeJPEG(thumb, resize(src, box)); err != nil {
+			return false, err
 		}
 	}
+	return true, nil
+}
 
-	of, err := os.Create(path + ".thumb.jpg")
+func writeJPEG(path string, img image.Image) error {
+	of, err := os.Create(path + ".tmp")
 	if err != nil {
 		return err
 	}
-	defer of.Close()
+	err = jpeg.Encode(of, img, &jpeg.Options{Quality: 85})
+	if err1 := of.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+	}
+	return err
+}
+
+// resize scales src to fit in the box by Catmull-Rom, src should start at (0, 0)
+func resize(src *image.RGBA, box int) *image.RGBA {
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	k := math.Max(float64(w), float64(h)) / float64(box)
+	dw, dh := int(math.Max(1, math.Round(float64(w)/k))), int(math.Max(1, math.Round(float64(h)/k)))
+
+	// both passes scale rows and write them as columns, so the second one scales the columns
+	pix := resizeRows(src.Pix, src.Stride, w, h, dw)
+	pix = resizeRows(pix, h*4, h, dw, dh)
+	return &image.RGBA{Pix: pix, Stride: dw * 4, Rect: image.Rect(0, 0, dw, dh)}
+}
+
+type contrib struct {
+	start   int
+	weights []float32
+}
+
+func catmullRom(x float64) float64 {
+	if x = math.Abs(x); x < 1 {
+		return (1.5*x-2.5)*x*x + 1
+	} else if x < 2 {
+		return ((-0.5*x+2.5)*x-4)*x + 2
+	}
+	return 0
+}
 
-	return jpeg.Encode(of, canvas, &jpeg.Options{Quality: 70})
+// contribs returns which source pixels make up each of the dst pixels and their weights
+func contribs(src, dst int) []contrib {
+	scale := float64(src) / float64(dst)
+	filterScale := math.Max(scale, 1)
+	radius := 2 * filterScale
+
+	res := make([]contrib, dst)
+	for x := range res {
+		center := (float64(x) + 0.5) * scale
+		start, end := int(math.Ceil(center-radius-0.5)), int(math.Floor(center+radius-0.5))
+		if start < 0 {
+			start = 0
+		}
+		if end > src-1 {
+			end = src - 1
+		}
+
+		c, sum := contrib{start: start}, float32(0)
+		for i := start; i <= end; i++ {
+			w := float32(catmullRom((float64(i) + 0.5 - center) / filterScale))
+			c.weights = append(c.weights, w)
+			sum += w
+		}
+		for i := range c.weights {
+			c.weights[i] /= sum
+		}
+		res[x] = c
+	}
+	return res
+}
+
+// resizeRows scales each of the h rows of w RGBA pixels to dw pixels, the result is transposed: dw rows of h pixels
+func resizeRows(pix []uint8, stride, w, h, dw int) []uint8 {
+	cs := contribs(w, dw)
+	dst := make([]uint8, dw*h*4)
+	for y := 0; y < h; y++ {
+		row := pix[y*stride:]
+		for x, c := range cs {
+			var r, g, b, a float32
+			for i, w := range c.weights {
+				p := row[(c.start+i)*4:]
+				r += float32(p[0]) * w
+				g += float32(p[1]) * w
+				b += float32(p[2]) * w
+				a += float32(p[3]) * w
+			}
+			o := (x*h + y) * 4
+			dst[o], dst[o+1], dst[o+2], dst[o+3] = clamp8(r), clamp8(g), clamp8(b), clamp8(a)
+		}
+	}
+	return dst
+}
+
+func clamp8(v float32) uint8 {
+	if v < 0 {
+		return 0
+	} else if v > 255 {
+		return 255
+	}
+	return uint8(v + 0.5)
 }
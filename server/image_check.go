@@ -0,0 +1,199 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrImageFormat   = fmt.Errorf("image doesn't match its extension")
+	ErrImageTooLarge = fmt.Errorf("image has too many pixels")
+)
+
+// CheckImage decodes the uploaded image at path to make sure it is what ext says,
+// images larger than maxPixels are rejected before being decoded.
+// JPEGs are rotated as their EXIF says and re-encoded without any metadata, SVGs are sanitized.
+// It returns the width and height of the image, 0 if unknown (e.g. SVGs without sizes),
+// and the new contents of the file if it is rewritten, nil if it is kept as uploaded.
+func CheckImage(path, ext string, maxPixels int) (x, y uint16, rewritten []byte, err error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	ext = strings.TrimPrefix(strings.ToLower(ext), ".")
+	if ext == "svg" {
+		if buf, err = SanitizeSVG(buf); err != nil {
+			return 0, 0, nil, ErrImageFormat
+		}
+		if x, y, err = checkSVG(buf); err != nil {
+			return 0, 0, nil, err
+		}
+		if err := ioutil.WriteFile(path, buf, 0644); err != nil {
+			return 0, 0, nil, err
+		}
+		return x, y, buf, nil
+	}
+	if ext == "jpg" {
+		ext = "jpeg"
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(buf))
+	if err != nil || format != ext {
+		return 0, 0, nil, ErrImageFormat
+	}
+	if config.Width > 0xffff || config.Height > 0xffff || config.Width*config.Height > maxPixels {
+		return 0, 0, nil, ErrImageTooLarge
+	}
+
+	var img image.Image
+	if format == "gif" {
+		img, err = gif.Decode(bytes.NewReader(buf))
+	} else {
+		img, _, err = image.Decode(bytes.NewReader(buf))
+	}
+	if err != nil {
+		return 0, 0, nil, ErrImageFormat
+	}
+
+	if format == "jpeg" {
+		img = orient(img, exifOrientation(buf))
+		out := &bytes.Buffer{}
+		if err := jpeg.Encode(out, img, &jpeg.Options{Quality: 90}); err != nil {
+			return 0, 0, nil, err
+		}
+		if err := ioutil.WriteFile(path, out.Bytes(), 0644); err != nil {
+			return 0, 0, nil, err
+		}
+		rewritten = out.Bytes()
+	}
+
+	b := img.Bounds()
+	return uint16(b.Dx()), uint16(b.Dy()), rewritten, nil
+}
+
+// checkSVG makes sure the root element is <svg>, sizes in width and height are returned if they are plain numbers
+func checkSVG(buf []byte) (x, y uint16, err error) {
+	d := xml.NewDecoder(bytes.NewReader(buf))
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return 0, 0, ErrImageFormat
+		}
+		el, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if el.Name.Local != "svg" {
+			return 0, 0, ErrImageFormat
+		}
+		for _, a := range el.Attr {
+			v, _ := strconv.ParseFloat(strings.TrimSuffix(a.Value, "px"), 64)
+			if v <= 0 || v > 0xffff {
+				continue
+			}
+			switch a.Name.Local {
+			case "width":
+				x = uint16(v)
+			case "height":
+				y = uint16(v)
+			}
+		}
+		return x, y, nil
+	}
+}
+
+// exifOrientation returns the orientation (1 ~ 8) in the EXIF of the JPEG, 1 if there is none
+func exifOrientation(buf []byte) int {
+	if len(buf) < 2 || buf[0] != 0xff || buf[1] != 0xd8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(buf) && buf[i] == 0xff; {
+		marker, size := buf[i+1], int(binary.BigEndian.Uint16(buf[i+2:]))
+		if marker == 0xda || size < 2 || i+2+size > len(buf) {
+			// start of scan, no more metadata
+			break
+		}
+		if seg := buf[i+4 : i+2+size]; marker == 0xe1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+			return tiffOrientation(seg[6:])
+		}
+		i += 2 + size
+	}
+	return 1
+}
+
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder = binary.BigEndian
+	if string(tiff[:2]) == "II" {
+		order = binary.LittleEndian
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+	n := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < n; i++ {
+		e := ifd + 2 + i*12
+		if e+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[e:]) == 0x0112 {
+			if o := int(order.Uint16(tiff[e+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+			break
+		}
+	}
+	return 1
+}
+
+// orient transforms the image by the EXIF orientation so it can be displayed as is
+func orient(img image.Image, o int) image.Image {
+	if o <= 1 || o > 8 {
+		return img
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if o >= 5 {
+		dw, dh = h, w
+	}
+
+	canvas := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for x := 0; x < w; x++ {
+		for y := 0; y < h; y++ {
+			dx, dy := x, y
+			switch o {
+			case 2:
+				dx = w - 1 - x
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dy = h - 1 - y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			canvas.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return canvas
+}
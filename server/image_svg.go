@@ -0,0 +1,152 @@
+package server
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// SVGCSP is sent with SVGs, scripts can't run even if an SVG slipped through SanitizeSVG
+const SVGCSP = "default-src 'none'; style-src 'unsafe-inline'; img-src data:; sandbox"
+
+// elements dropped with their children, in lower case
+var svgBadElements = map[string]bool{
+	"script":        true,
+	"foreignobject": true,
+	"iframe":        true,
+	"embed":         true,
+	"object":        true,
+	"handler":       true,
+	"listener":      true,
+}
+
+var (
+	rxSVGDataImage = regexp.MustCompile(`^data:image/(png|jpeg|gif);base64,`)
+	rxCSSURL       = regexp.MustCompile(`(?i)url\s*\(\s*['"]?\s*([^'")\s]*)`)
+)
+
+// svgSafeRef allows references to elements of the SVG and embedded bitmaps only
+func svgSafeRef(v string) bool {
+	v = strings.TrimSpace(v)
+	return strings.HasPrefix(v, "#") || rxSVGDataImage.MatchString(v)
+}
+
+func svgSafeCSS(v string) bool {
+	l := strings.ToLower(v)
+	if strings.Contains(l, "@import") || strings.Contains(l, "expression(") || strings.Contains(l, "javascript:") {
+		return false
+	}
+	for _, m := range rxCSSURL.FindAllStringSubmatch(v, -1) {
+		if !svgSafeRef(m[1]) {
+			return false
+		}
+	}
+	return true
+}
+
+func svgSafeAttr(el string, a xml.Attr) bool {
+	name, v := strings.ToLower(a.Name.Local), strings.ToLower(strings.Join(strings.Fields(a.Value), ""))
+	switch {
+	case strings.HasPrefix(name, "on"), a.Name.Space == "xml" && name == "base":
+		return false
+	case a.Name.Space == "" && name == "xmlns", a.Name.Space == "xmlns" && name == "svg":
+		// unprefixed elements must stay SVG, e.g. not XHTML
+		return strings.TrimSpace(a.Value) == "http://www.w3.org/2000/svg"
+	case name == "href", name == "src":
+		return svgSafeRef(a.Value)
+	case name == "style":
+		return svgSafeCSS(a.Value)
+	case name == "attributename" && (el == "set" || strings.HasPrefix(el, "animate")):
+		// animations can set links or handlers
+		return v != "href" && !strings.HasSuffix(v, ":href") && !strings.HasPrefix(v, "on")
+	}
+	return !strings.Contains(v, "javascript:") && svgSafeCSS(a.Value)
+}
+
+// SanitizeSVG rewrites the SVG without scripts, event handlers, foreign objects and external references,
+// so it can't run scripts or load anything when opened from the forum. Comments, DTDs and
+// processing instructions (e.g. <?xml-stylesheet?>) are dropped too.
+func SanitizeSVG(buf []byte) ([]byte, error) {
+	d := xml.NewDecoder(bytes.NewReader(buf))
+	w := &bytes.Buffer{}
+	w.WriteString(xml.Header)
+
+	var stack []xml.Name
+	var styles []bool // whether the text in each <style> is kept
+	skip, root := 0, false
+	for {
+		// raw tokens keep prefixes as they are, so the output is the same as the input except dropped parts
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			stack = append(stack, t.Name)
+			el := strings.ToLower(t.Name.Local)
+			if skip > 0 || svgBadElements[el] || (t.Name.Space != "" && t.Name.Space != "svg") {
+				skip++
+				continue
+			}
+			if len(stack) == 1 {
+				if root || el != "svg" {
+					return nil, ErrImageFormat
+				}
+				root = true
+			}
+
+			w.WriteString("<" + svgName(t.Name))
+			for _, a := range t.Attr {
+				if svgSafeAttr(el, a) {
+					w.WriteString(" " + svgName(a.Name) + `="`)
+					xml.EscapeText(w, []byte(a.Value))
+					w.WriteString(`"`)
+				}
+			}
+			w.WriteString(">")
+			if el == "style" {
+				styles = append(styles, true)
+			}
+		case xml.EndElement:
+			if len(stack) == 0 || stack[len(stack)-1] != t.Name {
+				return nil, fmt.Errorf("unexpected </%s>", svgName(t.Name))
+			}
+			stack = stack[:len(stack)-1]
+			if skip > 0 {
+				skip--
+				continue
+			}
+			if strings.ToLower(t.Name.Local) == "style" {
+				styles = styles[:len(styles)-1]
+			}
+			w.WriteString("</" + svgName(t.Name) + ">")
+		case xml.CharData:
+			if skip > 0 || len(stack) == 0 {
+				continue
+			}
+			if len(styles) > 0 && !svgSafeCSS(string(t)) {
+				continue
+			}
+			xml.EscapeText(w, t)
+		}
+	}
+
+	if !root || len(stack) > 0 {
+		return nil, ErrImageFormat
+	}
+	return w.Bytes(), nil
+}
+
+func svgName(n xml.Name) string {
+	if n.Space != "" {
+		return n.Space + ":" + n.Local
+	}
+	return n.Local
+}
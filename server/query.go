@@ -0,0 +1,207 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Query is a parsed search of /list, zero values match everything
+type Query struct {
+	Text      string   // free text, posts matching more than half of its bigrams
+	Phrases   []string // quoted, posts containing all of them
+	Term      [8]byte  // an IP or user, see /list?q=
+	Author    [8]byte  // author:
+	IP        string   // ip: a prefix like 1.2.
+	After     uint32   // after: inclusive
+	Before    uint32   // before: exclusive
+	Topic     uint32   // in:
+	Tag       string   // tag:
+	HasImage  bool     // has:image
+	IsOP      bool     // is:op, first posts of topics
+	IsDeleted bool     // is:deleted
+}
+
+// ParseQuery parses text like: author:*name ip:1.2. before:2019-05-01 after:2019-04-01 has:image is:op is:deleted in:123 tag:go "a phrase" words,
+// the legacy forms ">>longid text" and "!!tag" are also accepted
+func ParseQuery(text string) (*Query, error) {
+	q := &Query{}
+	text = strings.TrimSpace(text)
+
+	if strings.HasPrefix(text, "!!") {
+		if q.Tag = NormalizeTag(text[2:]); q.Tag == "" {
+			return nil, fmt.Errorf("invalid tag")
+		}
+		q.IsOP = true
+		return q, nil
+	}
+
+	if strings.HasPrefix(text, ">>") {
+		idx := strings.Index(text, " ")
+		if idx == -1 {
+			return nil, fmt.Errorf("missing text after the post ID")
+		}
+		longID, _ := strconv.ParseUint(text[2:idx], 10, 64)
+		if q.Topic, _ = SplitID(longID); q.Topic == 0 {
+			return nil, fmt.Errorf("invalid post ID")
+		}
+		text = text[idx+1:]
+	}
+
+	words := []string{}
+	for len(text) > 0 {
+		var w string
+		if text[0] == '"' {
+			// an unclosed quote runs to the end
+			if end := strings.IndexByte(text[1:], '"'); end == -1 {
+				w, text = text[1:], ""
+			} else {
+				w, text = text[1:end+1], strings.TrimSpace(text[end+2:])
+			}
+			if w = strings.ToLower(strings.TrimSpace(w)); w != "" {
+				q.Phrases = append(q.Phrases, w)
+			}
+			continue
+		}
+
+		if end := strings.IndexAny(text, " \t\r\n"); end == -1 {
+			w, text = text, ""
+		} else {
+			w, text = text[:end], strings.TrimSpace(text[end:])
+		}
+
+		ok, err := q.parseOperator(w)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			words = append(words, w)
+		}
+	}
+
+	q.Text = strings.Join(words, " ")
+	if q.After > 0 && q.Before > 0 && q.After >= q.Before {
+		return nil, fmt.Errorf("empty date range")
+	}
+	return q, nil
+}
+
+// parseOperator returns false if w is not an operator
+func (q *Query) parseOperator(w string) (bool, error) {
+	idx := strings.Index(w, ":")
+	if idx <= 0 {
+		return false, nil
+	}
+
+	key, v := strings.ToLower(w[:idx]), w[idx+1:]
+	switch key {
+	case "author":
+		if q.Author = Parse8Bytes(v); q.Author == default8Bytes {
+			return false, fmt.Errorf("invalid author: %s", v)
+		}
+	case "ip":
+		if v = strings.TrimSuffix(v, "x"); v == "" {
+			return false, fmt.Errorf("invalid IP")
+		}
+		q.IP = v
+	case "before", "after":
+		t, err := time.ParseInLocation("2006-01-02", v, time.Local)
+		if err != nil {
+			return false, fmt.Errorf("invalid date: %s, format: 2006-01-02", v)
+		}
+		if key == "before" {
+			q.Before = uint32(t.Unix())
+		} else {
+			q.After = uint32(t.Unix())
+		}
+	case "has":
+		if v != "image" {
+			return false, fmt.Errorf("unknown has:%s", v)
+		}
+		q.HasImage = true
+	case "is":
+		switch v {
+		case "op":
+			q.IsOP = true
+		case "deleted":
+			q.IsDeleted = true
+		default:
+			return false, fmt.Errorf("unknown is:%s", v)
+		}
+	case "in":
+		id, err := strconv.ParseUint(v, 10, 32)
+		if err != nil || id == 0 {
+			return false, fmt.Errorf("invalid topic ID: %s", v)
+		}
+		q.Topic = uint32(id)
+	case "tag":
+		if q.Tag = NormalizeTag(v); q.Tag == "" {
+			return false, fmt.Errorf("invalid tag: %s", v)
+		}
+	default:
+		// e.g. http://...
+		return false, nil
+	}
+	return true, nil
+}
+
+// ModOnly tells if the query needs moderators' permissions, users can only search themselves by author: and /list?q=
+func (q *Query) ModOnly(u User) bool {
+	return q.IP != "" || q.IsDeleted ||
+		(q.Author != default8Bytes && q.Author != u.ID) ||
+		(q.Term != default8Bytes && q.Term != u.ID)
+}
+
+// indexed tells if candidates can be found in the text index
+func (q *Query) indexed() bool {
+	return (q.Text != "" || len(q.Phrases) > 0) && !q.IsDeleted
+}
+
+func (q *Query) bigrams() []uint32 {
+	return bigrams(q.Text+" "+strings.Join(q.Phrases, " "), 128)
+}
+
+// match checks p against everything but the text, which is checked by the caller
+func (q *Query) match(p *Post) bool {
+	return q.matchMeta(p) && q.matchPhrases(p)
+}
+
+// matchMeta checks p against everything but the text and phrases, archived posts have no messages here
+func (q *Query) matchMeta(p *Post) bool {
+	if p.IsMoved() || p.IsDeleted() != q.IsDeleted {
+		return false
+	}
+	if (q.Topic > 0 && p.Topic.ID != q.Topic) || (q.Tag != "" && !p.Topic.HasTag(q.Tag)) {
+		return false
+	}
+	if (q.IsOP && p.ID != 1) || (q.HasImage && p.Image == nil) {
+		return false
+	}
+	if (q.After > 0 && p.CreatedAt < q.After) || (q.Before > 0 && p.CreatedAt >= q.Before) {
+		return false
+	}
+	if q.Author != default8Bytes && p.UserXor() != q.Author {
+		return false
+	}
+	if q.Term != default8Bytes && p.UserXor() != q.Term && p.IPXor() != q.Term {
+		return false
+	}
+	if q.IP != "" && !strings.HasPrefix(p.IP(), q.IP) {
+		return false
+	}
+	return true
+}
+
+func (q *Query) matchPhrases(p *Post) bool {
+	if len(q.Phrases) == 0 {
+		return true
+	}
+	text := strings.ToLower(postText(p))
+	for _, ph := range q.Phrases {
+		if !strings.Contains(text, ph) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrLogMismatch = fmt.Errorf("log offset or digest mismatch")
+	errReadOnly    = fmt.Errorf("store is read-only")
+)
+
+// ReplicaToken is what replicas send to the primary, both sides share the same salt
+func ReplicaToken(password string) string {
+	h := sha1.Sum([]byte("replica:" + password))
+	return hex.EncodeToString(h[:])
+}
+
+func (store *Store) IsReadOnly() bool { return atomic.LoadUintptr(&store.readOnly) == 1 }
+
+// SetReadOnly rejects all writes from now on, call it before Follow starts
+func (store *Store) SetReadOnly() { atomic.StoreUintptr(&store.readOnly, 1) }
+
+func (store *Store) appendSignal() <-chan struct{} {
+	store.signalLock.Lock()
+	defer store.signalLock.Unlock()
+	if store.signal == nil {
+		store.signal = make(chan struct{})
+	}
+	return store.signal
+}
+
+// notifyAppend wakes up all ReadLog waiters
+func (store *Store) notifyAppend() {
+	store.signalLock.Lock()
+	defer store.signalLock.Unlock()
+	if store.signal != nil {
+		close(store.signal)
+		store.signal = nil
+	}
+}
+
+// ReadLog waits up to timeout for bytes after offset and passes them to fn along with the committed size.
+// d is the digest of the replica's copy before offset, ErrLogMismatch means the replica has to start over from 0.
+func (store *Store) ReadLog(offset int64, d string, timeout time.Duration, fn func(end int64, r io.Reader) error) error {
+	deadline := time.After(timeout)
+	for {
+		// get the signal first, so appends after reading ptr won't be missed
+		signal := store.appendSignal()
+
+		store.RLock()
+		f, end := store.dataFile, store.ptr
+		store.RUnlock()
+
+		if f == nil {
+			return fmt.Errorf("store not ready")
+		}
+
+		if offset > 0 {
+			if offset < 16 || offset > end {
+				return ErrLogMismatch
+			}
+			if x, err := digest(f, offset); err != nil {
+				return err
+			} else if x != d {
+				return ErrLogMismatch
+			}
+		}
+
+		if offset < end {
+			return fn(end, io.NewSectionReader(f, offset, end-offset))
+		}
+
+		select {
+		case <-signal:
+		case <-deadline:
+			return fn(end, io.NewSectionReader(f, end, 0))
+		}
+	}
+}
+
+// Follow pulls the data file from the primary at u forever, the store becomes read-only.
+// onload is called after the config has been changed by the primary.
+func (store *Store) Follow(u, token string, logger *Logger, onload func(*Store)) {
+	store.SetReadOnly()
+
+	for {
+		if !store.IsReady() {
+			time.Sleep(time.Second)
+			continue
+		}
+
+		n, err := store.pull(u, token, logger, onload)
+		if err == ErrLogMismatch {
+			logger.Notice("replica is out of sync with the primary, start over")
+			store.Lock()
+			err = store.reset()
+			store.Unlock()
+		}
+		if err != nil {
+			logger.Error("failed to follow %s: %v", u, err)
+			time.Sleep(time.Second * 5)
+		} else if n > 0 {
+			logger.Notice("replicated %d bytes from %s", n, u)
+		}
+	}
+}
+
+func (store *Store) pull(u, token string, logger *Logger, onload func(*Store)) (int64, error) {
+	store.RLock()
+	offset := store.ptr
+	store.RUnlock()
+
+	if offset == 16 {
+		// a new replica copies the header too
+		offset = 0
+	}
+
+	d, err := digest(store.dataFile, offset)
+	if offset == 0 {
+		d, err = "", nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	q := url.Values{}
+	q.Set("offset", strconv.FormatInt(offset, 10))
+	q.Set("digest", d)
+	q.Set("token", token)
+
+	resp, err := http.Get(u + "/replicate?" + q.Encode())
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusConflict:
+		return 0, ErrLogMismatch
+	default:
+		return 0, fmt.Errorf("primary responded: %s", resp.Status)
+	}
+
+	end, err := strconv.ParseInt(resp.Header.Get("X-Log-Size"), 10, 64)
+	if err != nil || end < offset {
+		return 0, fmt.Errorf("invalid log size: %q", resp.Header.Get("X-Log-Size"))
+	}
+	if end == offset {
+		return 0, nil
+	}
+
+	// write the bytes first, then replay them from the local file, nothing is committed until both succeed
+	var n int64
+	for buf := make([]byte, 1024*1024); n < end-offset; {
+		x, err := resp.Body.Read(buf)
+		if x > 0 {
+			if _, err := store.dataFile.WriteAt(buf[:x], offset+n); err != nil {
+				return 0, err
+			}
+			n += int64(x)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	if n != end-offset {
+		return 0, fmt.Errorf("short read: %d/%d", n, end-offset)
+	}
+
+	store.Lock()
+	defer store.Unlock()
+
+	if offset == 0 {
+		_, flag, err := readHeader(store.dataFile)
+		if err != nil {
+			return 0, err
+		}
+		store.utf8 = flag&HEADER_UTF8 > 0
+		offset = 16
+	}
+
+	config := store.configStr
+	if err := store.replay(offset, end); err != nil {
+		// the store may be half updated, start over
+		logger.Error("failed to replay 0x%08x-0x%08x: %v", offset, end, err)
+		return 0, ErrLogMismatch
+	}
+	if err := commitHeader(store.dataFile, end); err != nil {
+		return 0, err
+	}
+	store.ptr = end
+
+	if config != store.configStr && onload != nil {
+		onload(store)
+	}
+	return n, nil
+}
+
+// replay applies ops in [start, end) of the data file, the caller should hold the lock
+func (store *Store) replay(start, end int64) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	r := &buffer{utf8: store.utf8}
+	r.SetReader(bufio.NewReader(io.NewSectionReader(store.dataFile, start, end-start)))
+	r.pos = start
+
+	print := func(string, ...interface{}) {}
+	for r.pos < end {
+		op, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		store.applyOp(op, r, print)
+	}
+	return nil
+}
+
+// reset clears the store and its data file, the caller should hold the lock
+func (store *Store) reset() error {
+	if err := store.dataFile.Truncate(16); err != nil {
+		return err
+	}
+	if err := commitHeader(store.dataFile, 16); err != nil {
+		return err
+	}
+
+	store.rootTopic, store.endTopic = &Topic{}, &Topic{}
+	store.rootTopic.Next = store.endTopic
+	store.endTopic.Prev = store.rootTopic
+	store.topics = make(map[uint32]*Topic)
+	store.blocked = make(map[[8]byte]bool)
+	store.redirects = make(map[uint64]uint64)
+	store.tags = make(map[string]map[uint32]bool)
+	store.index = newTextIndex()
+	store.topicsCount, store.LiveTopicsNum = 0, 0
+	store.configStr = ""
+	store.ptr = 16
+	return nil
+}
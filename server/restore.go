@@ -0,0 +1,95 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// RestorePoint is where Restore stops replaying, ops at or after it are dropped.
+// Time stops at the first op known to be after it: posts and edits by their own times, other ops by
+// OP_TIME written before them. Data files of older versions have no OP_TIME, ops before the first post
+// created after Time are kept then.
+type RestorePoint struct {
+	Offset int64
+	Time   uint32
+}
+
+// Restore replays the data file up to p and writes the result into output as a snapshot,
+// dropped ops are dumped to w. It returns the offset where replaying stopped.
+func Restore(path string, password [16]byte, p RestorePoint, output string, w io.Writer) (int64, error) {
+	if p.Offset <= 0 && p.Time == 0 {
+		return 0, fmt.Errorf("restore point not set")
+	}
+
+	// first pass, find the cutoff and ops after it
+	var (
+		cutoff, last int64 = -1, -1
+		dropped      []*dumpLine
+		topicOps     = map[uint32][2]int64{} // offset of OP_TOPIC and the op before it
+	)
+
+	store := newDummyStore(password)
+	store.onReplay = func(pos int64, op byte, res opResult) bool {
+		if cutoff == -1 {
+			switch {
+			case p.Offset > 0 && pos >= p.Offset:
+				cutoff = pos
+			case p.Time > 0 && op == OP_TIME && res.num > p.Time:
+				cutoff = pos
+			case p.Time > 0 && op == OP_EDIT && res.post.EditedAt > p.Time:
+				cutoff = pos
+			case p.Time > 0 && op == OP_POST && res.post.CreatedAt > p.Time:
+				cutoff = pos
+				if res.post.ID == 1 {
+					// OP_TOPIC of a new topic is followed by its first OP_POST, drop them together.
+					// Split topics have no OP_POST, they are cut by the OP_TIME before their OP_TOPIC
+					t := topicOps[res.topic.ID]
+					cutoff, last = t[0], t[1]
+					dropped = append(dropped, newDumpLine(t[0], OP_TOPIC, opResult{topic: res.topic}))
+				}
+			}
+		}
+
+		if cutoff == -1 {
+			if op == OP_TOPIC {
+				topicOps[res.topic.ID] = [2]int64{pos, last}
+			}
+			last = pos
+		} else {
+			dropped = append(dropped, newDumpLine(pos, op, res))
+		}
+		return true
+	}
+
+	if err := store.loadDB(path, true, nil); err != nil {
+		return 0, err
+	}
+	if cutoff == -1 {
+		return 0, fmt.Errorf("nothing to drop, restore point is beyond the end")
+	}
+
+	// second pass, replay ops before the cutoff
+	store = newDummyStore(password)
+	store.maxLiveTopics = 1024
+	if last >= 0 {
+		store.onReplay = func(pos int64, op byte, res opResult) bool { return pos < last }
+		if err := store.loadDB(path, true, nil); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := ioutil.WriteFile(output, store.marshal(), 0755); err != nil {
+		return 0, err
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	for _, l := range dropped {
+		if err := enc.Encode(l); err != nil {
+			return cutoff, err
+		}
+	}
+	return cutoff, nil
+}
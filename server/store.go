@@ -5,11 +5,11 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"math"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
@@ -21,6 +21,15 @@ import (
 
 var ErrInvalidTopic = fmt.Errorf("can't find the topic")
 
+var ErrTopicLocked = fmt.Errorf("topic is locked")
+
+// errors of EditPost
+var (
+	ErrEditDenied  = fmt.Errorf("can't edit others' or deleted posts")
+	ErrEditExpired = fmt.Errorf("edit window has passed")
+	ErrEditLocked  = fmt.Errorf("can't edit posts in locked topics")
+)
+
 const (
 	OP_NOP       = 'x'
 	OP_TOPIC     = 'T'
@@ -39,6 +48,54 @@ const (
 	OP_CONFIG    = 'C'
 	OP_MAXTOPICS = 'M'
 	OP_NSFW      = 'W'
+	OP_EDIT      = 'E'
+	OP_MOVE      = 'V'
+	OP_REDIRECT  = 'R'
+	OP_CONTINUE  = 'N'
+	OP_BOARD     = 'O'
+	OP_TAG       = 'K'
+	OP_UNTAG     = 'U'
+	OP_UNARCHIVE = 'Y'
+	OP_UNPURGE   = 'Q'
+	OP_DELIMAGE  = 'J'
+	OP_TIME      = 'Z'
+)
+
+var opNames = map[byte]string{
+	OP_NOP:       "NOP",
+	OP_TOPIC:     "TOPIC",
+	OP_TOPICNUM:  "TOPICNUM",
+	OP_POST:      "POST",
+	OP_APPEND:    "APPEND",
+	OP_IMAGE:     "IMAGE",
+	OP_DELETE:    "DELETE",
+	OP_BLOCK:     "BLOCK",
+	OP_STICKY:    "STICKY",
+	OP_SAGE:      "SAGE",
+	OP_LOCK:      "LOCK",
+	OP_ARCHIVE:   "ARCHIVE",
+	OP_PURGE:     "PURGE",
+	OP_FREEREPLY: "FREEREPLY",
+	OP_CONFIG:    "CONFIG",
+	OP_MAXTOPICS: "MAXTOPICS",
+	OP_NSFW:      "NSFW",
+	OP_EDIT:      "EDIT",
+	OP_MOVE:      "MOVE",
+	OP_REDIRECT:  "REDIRECT",
+	OP_CONTINUE:  "CONTINUE",
+	OP_BOARD:     "BOARD",
+	OP_TAG:       "TAG",
+	OP_UNTAG:     "UNTAG",
+	OP_UNARCHIVE: "UNARCHIVE",
+	OP_UNPURGE:   "UNPURGE",
+	OP_DELIMAGE:  "DELIMAGE",
+	OP_TIME:      "TIME",
+}
+
+// flags stored in the 4th byte of the 16-byte header
+const (
+	HEADER_SLOT = 1 << iota // which one of the two size slots is committed
+	HEADER_UTF8             // strings are stored as raw UTF-8 instead of the legacy plane 0 encoding
 )
 
 // Store describes store
@@ -51,15 +108,36 @@ type Store struct {
 	block         cipher.Block
 	ready         uintptr
 	ptr           int64
+	utf8          bool
 	maxLiveTopics int
 	dataFilePath  string
 	configStr     string
 	configLock    sync.RWMutex
+	backupLock    sync.Mutex
+	signalLock    sync.Mutex
+	signal        chan struct{} // closed after appending, see ReadLog
+	readOnly      uintptr       // a replica following the primary
 	rootTopic     *Topic
 	endTopic      *Topic
+	topics        map[uint32]*Topic
 	topicsCount   uint32
+	bumps         uint64
 	blocked       map[[8]byte]bool
+	redirects     map[uint64]uint64 // long IDs of moved posts
+	tags          map[string]map[uint32]bool
+	index         *textIndex     // nil in dummy stores
+	archive       *archiveIndex  // nil in dummy stores
+	images        map[string]int // see countImages
+	imageHolds    map[string]int // see HoldImage
+	lastArchive   ArchiveResult
 	dataFile      *os.File
+	onReplay      func(int64, byte, opResult) bool // called after each op replayed by loadDB, return false to stop
+}
+
+func (store *Store) DataSize() int64 {
+	store.RLock()
+	defer store.RUnlock()
+	return store.ptr
 }
 
 func (store *Store) LoadingProgress() float64 { return float64(atomic.LoadUintptr(&store.ready)) / 1000 }
@@ -105,10 +183,14 @@ func (store *Store) OperateTopic(topicID uint32, action byte) error {
 			t.Saged = !t.Saged
 		}
 	case OP_PURGE:
+		// recoverable by UnpurgeTopic until the trash is emptied, a failed purge leaves nothing in the trash
+		if err = store.trash(t); err != nil {
+			break
+		}
 		if err = store.append(p.WriteByte(OP_PURGE).WriteUInt32(topicID).Bytes()); err == nil {
-			t.Prev.Next = t.Next
-			t.Next.Prev = t.Prev
-			store.LiveTopicsNum--
+			store.unlinkTopic(t)
+		} else {
+			os.Remove(store.trashPath(topicID))
 		}
 	}
 	return err
@@ -154,39 +236,102 @@ func (store *Store) TopicsCount() int {
 var DefaultTopicMapper = func(t *Topic) Topic { return *t }
 var DefaultTopicFilter = func(t *Topic) bool { return true }
 
-// GetTopics retuns topics
+// BoardFilter returns the filter of topics in board, "" is the main board
+func BoardFilter(board string) func(*Topic) bool {
+	return func(t *Topic) bool { return t.Board == board }
+}
+
+// GetTopics retuns topics, start is counted in topics passing the filter
 func (store *Store) GetTopics(start, length int, filter func(*Topic) bool, mapper func(*Topic) Topic) []Topic {
 	res := make([]Topic, 0, length)
 	store.RLock()
 	defer store.RUnlock()
 
 	topic, i := store.rootTopic.Next, 0
-	for ; topic != store.endTopic; topic, i = topic.Next, i+1 {
-		if i >= start && len(res) < length {
-			if filter(topic) {
-				res = append(res, mapper(topic))
-				continue
-			}
+	for ; topic != store.endTopic && len(res) < length; topic = topic.Next {
+		if !filter(topic) {
+			continue
 		}
-		if len(res) >= length {
-			break
+		if i >= start {
+			res = append(res, mapper(topic))
 		}
+		i++
 	}
 	return res
 }
 
-func (store *Store) topicByIDUnlocked(id uint32) *Topic {
-	if id == 0 {
-		return nil
-	}
+// CountTopics returns the number of live topics passing the filter
+func (store *Store) CountTopics(filter func(*Topic) bool) int {
+	store.RLock()
+	defer store.RUnlock()
+
+	n := 0
 	for topic := store.rootTopic.Next; topic != store.endTopic; topic = topic.Next {
-		if id == topic.ID {
-			return topic
+		if filter(topic) {
+			n++
 		}
 	}
+	return n
+}
+
+// SetBoard moves the topic into board
+func (store *Store) SetBoard(topicID uint32, board string) error {
+	store.Lock()
+	defer store.Unlock()
+
+	topic := store.topicByIDUnlocked(topicID)
+	if topic == nil {
+		return ErrInvalidTopic
+	}
+
+	p := buffer{utf8: store.utf8}
+	if err := store.append(p.WriteByte(OP_BOARD).WriteUInt32(topicID).WriteString(board).Bytes()); err != nil {
+		return err
+	}
+	topic.Board = board
 	return nil
 }
 
+// MigrateTaggedTopics moves live topics whose subjects start with "!!" from the main board into board
+func (store *Store) MigrateTaggedTopics(board string) (int, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	p, topics := buffer{utf8: store.utf8}, []*Topic{}
+	for topic := store.rootTopic.Next; topic != store.endTopic; topic = topic.Next {
+		if topic.Board == "" && strings.HasPrefix(topic.Subject, "!!") {
+			p.WriteByte(OP_BOARD).WriteUInt32(topic.ID).WriteString(board)
+			topics = append(topics, topic)
+		}
+	}
+	if len(topics) == 0 {
+		return 0, nil
+	}
+	if err := store.append(p.Bytes()); err != nil {
+		return 0, err
+	}
+	for _, topic := range topics {
+		topic.Board = board
+	}
+	return len(topics), nil
+}
+
+func (store *Store) topicByIDUnlocked(id uint32) *Topic {
+	return store.topics[id]
+}
+
+// unlinkTopic removes the topic from the live list and the ID index
+func (store *Store) unlinkTopic(t *Topic) {
+	t.Prev.Next = t.Next
+	t.Next.Prev = t.Prev
+	store.LiveTopicsNum--
+	store.untagAll(t)
+	for i := range t.Posts {
+		store.unindexPost(&t.Posts[i])
+	}
+	delete(store.topics, t.ID)
+}
+
 func (store *Store) GetTopic(id uint32, filter func(*Topic) Topic) Topic {
 	store.RLock()
 	defer store.RUnlock()
@@ -198,7 +343,7 @@ func (store *Store) GetTopic(id uint32, filter func(*Topic) Topic) Topic {
 }
 
 func (store *Store) getPostPtrUnlocked(postLongID uint64) (*Post, error) {
-	topicID, postID := SplitID(postLongID)
+	topicID, postID := SplitID(store.redirectUnlocked(postLongID))
 	topic := store.topicByIDUnlocked(topicID)
 	if nil == topic {
 		return nil, fmt.Errorf("can't find topic ID: %d", topicID)
@@ -220,12 +365,49 @@ func (store *Store) AppendPost(postLongID uint64, msg string) error {
 		return err
 	}
 
-	var p buffer
+	p := buffer{utf8: store.utf8}
 	if err := store.append(p.WriteByte(OP_APPEND).WriteUInt32(post.Topic.ID).WriteUInt16(post.ID).WriteString(msg).Bytes()); err != nil {
 		return err
 	}
 
+	store.unindexPost(post)
 	post.Message += msg
+	store.indexPost(post)
+	return nil
+}
+
+// EditPost replaces the message of a post and keeps the old one as a revision,
+// authors can only edit their posts within window seconds (never if window < 0), unless the topic is locked by moderators.
+func (store *Store) EditPost(u User, postLongID uint64, msg string, window int) error {
+	store.Lock()
+	defer store.Unlock()
+
+	post, err := store.getPostPtrUnlocked(postLongID)
+	if err != nil {
+		return err
+	}
+
+	now := uint32(time.Now().Unix())
+	if !u.Can(PERM_APPEND_ANNOUNCE) {
+		if u.ID != post.UserXor() || post.IsDeleted() {
+			return ErrEditDenied
+		}
+		if window < 0 || int64(now)-int64(post.CreatedAt) > int64(window) {
+			return ErrEditExpired
+		}
+	}
+	if post.Topic.Locked && post.Topic.ContinuedBy == 0 && !u.CanModerate() {
+		return ErrEditLocked
+	}
+
+	p := buffer{utf8: store.utf8}
+	if err := store.append(p.WriteByte(OP_EDIT).WriteUInt32(post.Topic.ID).WriteUInt16(post.ID).WriteUInt32(now).WriteString(msg).Bytes()); err != nil {
+		return err
+	}
+
+	store.unindexPost(post)
+	post.edit(msg, now)
+	store.indexPost(post)
 	return nil
 }
 
@@ -234,6 +416,10 @@ func (store *Store) moveTopicToFront(topic *Topic) {
 		return
 	}
 
+	// stickies stay ahead of other topics, both are ordered by bumped
+	store.bumps++
+	topic.bumped = store.bumps
+
 	root := store.rootTopic.Next
 	if !topic.Sticky {
 		for ; root != store.endTopic; root = root.Next {
@@ -263,7 +449,8 @@ func (store *Store) moveTopicToFront(topic *Topic) {
 
 var errTooManyPosts = fmt.Errorf("too many posts")
 
-func (store *Store) addNewPost(msg string, image *Image, user, ipAddr [8]byte, topic *Topic, sage bool) (uint64, error) {
+// addNewPost appends the post with ops in tail together
+func (store *Store) addNewPost(msg string, image *Image, user, ipAddr [8]byte, topic *Topic, sage bool, tail []byte) (uint64, error) {
 	newTopic := len(topic.Posts) == 0
 	nextID := len(topic.Posts) + 1
 	if nextID > 4000 {
@@ -291,12 +478,16 @@ func (store *Store) addNewPost(msg string, image *Image, user, ipAddr [8]byte, t
 		p.SetStatus(POST_ISSAGE)
 	}
 
-	var topicStr buffer
+	topicStr := buffer{utf8: store.utf8}
 	if newTopic {
 		topicStr.WriteByte(OP_TOPIC)
 		topicStr.WriteUInt32(uint32(topic.ID))
 		topicStr.WriteString(topic.Subject)
 
+		if topic.Board != "" {
+			topicStr.WriteByte(OP_BOARD).WriteUInt32(topic.ID).WriteString(topic.Board)
+		}
+
 		if sage {
 			topicStr.WriteByte(OP_SAGE).WriteUInt32(topic.ID)
 		}
@@ -322,11 +513,15 @@ func (store *Store) addNewPost(msg string, image *Image, user, ipAddr [8]byte, t
 			WriteUInt16(image.Y)
 	}
 
-	if err := store.append(topicStr.Bytes()); err != nil {
+	if err := store.append(append(topicStr.Bytes(), tail...)); err != nil {
 		return 0, err
 	}
 
 	topic.Posts = append(topic.Posts, *p)
+	store.indexPost(&topic.Posts[len(topic.Posts)-1])
+	if image != nil {
+		store.acquireImage(image.Path)
+	}
 
 	if !sage || newTopic {
 		// as a new topic, even it is saged, it still has the opportunity to stay at the top for once
@@ -346,9 +541,17 @@ func (store *Store) buildArchivePath(topicID uint32) string {
 	return filepath.Join(filepath.Dir(store.dataFilePath), "archive", strconv.Itoa(id1), strconv.Itoa(id2), strconv.Itoa(int(topicID)))
 }
 
-func (topic *Topic) marshal() buffer {
-	buf := buffer{}
+// marshal uses the UTF-8 string format in snapshots and archives, see SnapshotStore and archive,
+// and the format of the data file in OP_UNARCHIVE and OP_UNPURGE
+func (topic *Topic) marshal(utf8 bool) buffer {
+	buf := buffer{utf8: utf8}
 	buf.WriteByte(OP_TOPIC).WriteUInt32(topic.ID).WriteString(topic.Subject)
+	if topic.Board != "" {
+		buf.WriteByte(OP_BOARD).WriteUInt32(topic.ID).WriteString(topic.Board)
+	}
+	for _, tag := range topic.Tags {
+		buf.WriteByte(OP_TAG).WriteUInt32(topic.ID).WriteString(tag)
+	}
 
 	for _, p := range topic.Posts {
 		buf.WriteByte(OP_POST).
@@ -358,7 +561,19 @@ func (topic *Topic) marshal() buffer {
 			WriteUInt32(p.CreatedAt).
 			Write8Bytes(p.ip).
 			Write8Bytes(p.user).
-			WriteString(p.Message) // this will include OP_APPEND
+			WriteString(p.Original()) // this will include OP_APPEND
+
+		for i := range p.Revisions {
+			msg, editedAt := p.Message, p.EditedAt
+			if i < len(p.Revisions)-1 {
+				msg, editedAt = p.Revisions[i+1].Message, p.Revisions[i+1].CreatedAt
+			}
+			buf.WriteByte(OP_EDIT).
+				WriteUInt32(topic.ID).
+				WriteUInt16(p.ID).
+				WriteUInt32(editedAt).
+				WriteString(msg)
+		}
 
 		if p.Image != nil {
 			buf.WriteByte(OP_IMAGE).
@@ -378,44 +593,119 @@ func (topic *Topic) marshal() buffer {
 		}
 	}
 
+	// written by both sides, so archives keep the links
+	if topic.ContinuedFrom > 0 {
+		buf.WriteByte(OP_CONTINUE).WriteUInt32(topic.ContinuedFrom).WriteUInt32(topic.ID)
+	}
+	if topic.ContinuedBy > 0 {
+		buf.WriteByte(OP_CONTINUE).WriteUInt32(topic.ID).WriteUInt32(topic.ContinuedBy)
+	}
+
 	return buf
 }
 
+// marshalFlags writes toggles of the topic, they are not kept in archives
+func (topic *Topic) marshalFlags(buf *buffer) {
+	if topic.Locked {
+		buf.WriteByte(OP_LOCK).WriteUInt32(topic.ID)
+	}
+
+	if topic.FreeReply {
+		buf.WriteByte(OP_FREEREPLY).WriteUInt32(topic.ID)
+	}
+
+	if topic.Saged {
+		buf.WriteByte(OP_SAGE).WriteUInt32(topic.ID)
+	}
+
+	if topic.Sticky {
+		// TODO: should be written in ID asc order
+		buf.WriteByte(OP_STICKY).WriteUInt32(topic.ID)
+	}
+}
+
 func archive(topic *Topic, saveToPath string) error {
+	return saveTopic(topic.marshal(true), saveToPath)
+}
+
+// saveTopic writes ops of a topic as a complete data file, see archive and trash
+func saveTopic(buf buffer, saveToPath string) error {
 	if err := os.MkdirAll(filepath.Dir(saveToPath), 0755); err != nil {
 		return err
 	}
-	buf := topic.marshal()
 	hdr := make([]byte, 16)
 	binary.BigEndian.PutUint64(hdr[2:], uint64(len(buf.Bytes())+16))
 	hdr = append(hdr, buf.Bytes()...)
-	hdr[0], hdr[1], hdr[2] = 'z', 'z', 'z'
+	hdr[0], hdr[1], hdr[2], hdr[3] = 'z', 'z', 'z', HEADER_UTF8
 	return ioutil.WriteFile(saveToPath, hdr, 0755)
 }
 
-func (store *Store) Dup(path string) error {
-	store.RLock()
-	defer store.RUnlock()
+// ArchivePolicy decides which live topics are archived by Archive besides the live topics cap
+type ArchivePolicy struct {
+	IdleDays    int            // archive topics not modified in these days, 0 to disable
+	BoardLimits map[string]int // max live topics in each board, "" is the main board
+}
 
-	os.Remove(path)
-	of, err := os.Create(path)
-	if err != nil {
-		return err
-	}
+// ArchiveResult is what the last Archive did
+type ArchiveResult struct {
+	Time     time.Time
+	Duration time.Duration
+	ByCount  int // over the live topics cap
+	ByIdle   int
+	ByBoard  int
+	Error    string
+}
 
-	defer of.Close()
-	if _, err := store.dataFile.Seek(0, 0); err != nil {
-		return err
+func (r ArchiveResult) Total() int { return r.ByCount + r.ByIdle + r.ByBoard }
+
+// Archive archives live topics by the policy, sticky topics are only archived by the live topics cap
+func (store *Store) Archive(policy ArchivePolicy) (ArchiveResult, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	res := ArchiveResult{Time: time.Now()}
+	idle := res.Time.Unix() - int64(policy.IdleDays)*86400
+	kept, boards, topics := 0, map[string]int{}, []*Topic{}
+
+	for t := store.rootTopic.Next; t != store.endTopic; t = t.Next {
+		lastActive := t.CreatedAt
+		if t.ModifiedAt > lastActive {
+			lastActive = t.ModifiedAt
+		}
+		limit, limited := policy.BoardLimits[t.Board]
+
+		switch {
+		case kept >= store.maxLiveTopics:
+			res.ByCount++
+		case !t.Sticky && policy.IdleDays > 0 && int64(lastActive) < idle:
+			res.ByIdle++
+		case !t.Sticky && limited && limit > 0 && boards[t.Board] >= limit:
+			res.ByBoard++
+		default:
+			kept++
+			boards[t.Board]++
+			continue
+		}
+		topics = append(topics, t)
 	}
 
-	_, err = io.Copy(of, store.dataFile)
-	return err
+	var err error
+	for _, t := range topics {
+		if err = store.archiveTopic(t); err != nil {
+			res.Error = err.Error()
+			break
+		}
+	}
+	res.Duration = time.Since(res.Time)
+	store.lastArchive = res
+	return res, err
 }
 
-func (store *Store) ArchiveJob() error {
-	store.Lock()
-	defer store.Unlock()
-	return store.archiveJob(store.maxLiveTopics)
+// LastArchive returns the result of the last Archive
+func (store *Store) LastArchive() ArchiveResult {
+	store.RLock()
+	defer store.RUnlock()
+	return store.lastArchive
 }
 
 func (store *Store) archiveJob(maxLiveTopics int) error {
@@ -427,22 +717,32 @@ func (store *Store) archiveJob(maxLiveTopics int) error {
 	}
 
 	for topic != store.endTopic.Prev && topic != store.endTopic {
-		t := store.endTopic.Prev
-		if err := archive(t, store.buildArchivePath(t.ID)); err != nil {
-			return err
-		}
-		var p buffer
-		if err := store.append(p.WriteByte(OP_ARCHIVE).WriteUInt32(t.ID).Bytes()); err != nil {
+		if err := store.archiveTopic(store.endTopic.Prev); err != nil {
 			return err
 		}
-		t.Prev.Next = t.Next
-		t.Next.Prev = t.Prev
-		store.LiveTopicsNum--
 	}
 	return nil
 }
 
+// archiveTopic moves the live topic into the archive, the caller should hold the lock
+func (store *Store) archiveTopic(t *Topic) error {
+	if err := archive(t, store.buildArchivePath(t.ID)); err != nil {
+		return err
+	}
+	var p buffer
+	if err := store.append(p.WriteByte(OP_ARCHIVE).WriteUInt32(t.ID).Bytes()); err != nil {
+		return err
+	}
+	store.unlinkTopic(t)
+	return store.indexArchived(t)
+}
+
 func (store *Store) NewTopic(subject, msg string, image *Image, user, ipAddr [8]byte, sage bool) (uint64, error) {
+	return store.NewTopicIn("", subject, msg, image, user, ipAddr, sage)
+}
+
+// NewTopicIn creates a new topic in board
+func (store *Store) NewTopicIn(board, subject, msg string, image *Image, user, ipAddr [8]byte, sage bool) (uint64, error) {
 	store.Lock()
 	defer store.Unlock()
 
@@ -453,20 +753,42 @@ func (store *Store) NewTopic(subject, msg string, image *Image, user, ipAddr [8]
 	topic := &Topic{
 		ID:      store.topicsCount + 1,
 		Subject: subject,
+		Board:   board,
 		Posts:   make([]Post, 0),
 		store:   store,
 	}
 
-	postLongID, err := store.addNewPost(msg, image, user, ipAddr, topic, sage)
+	postLongID, err := store.addNewPost(msg, image, user, ipAddr, topic, sage, nil)
 	if err == nil {
 		store.topicsCount++
 		store.LiveTopicsNum++
+		store.topics[topic.ID] = topic
 	}
 
 	return postLongID, err
 }
 
 func (store *Store) NewPost(topicID uint32, msg string, image *Image, user, ipAddr [8]byte, sage bool) (uint64, error) {
+	return store.ContinuePost(topicID, 0, msg, image, user, ipAddr, sage)
+}
+
+var rxContinuedSubject = regexp.MustCompile(`^(.*) #(\d+)$`)
+
+// continuedSubject bumps " #N" of a continuation, other topics get " #2" whatever their subjects end with
+func continuedSubject(topic *Topic) string {
+	subject, n := topic.Subject, 1
+	if m := rxContinuedSubject.FindStringSubmatch(subject); len(m) == 3 && topic.ContinuedFrom > 0 {
+		subject = m[1]
+		n, _ = strconv.Atoi(m[2])
+	}
+	return fmt.Sprintf("%s #%d", subject, n+1)
+}
+
+// ContinuePost posts to the last continuation of the topic. If it has limit (or 4000) posts,
+// a new topic with the same subject will be created to continue it, and the old one will be locked.
+// When limit is 0, the topic is locked at 4000 posts without being continued.
+// ErrTopicLocked is returned if the last continuation is locked by moderators.
+func (store *Store) ContinuePost(topicID uint32, limit int, msg string, image *Image, user, ipAddr [8]byte, sage bool) (uint64, error) {
 	store.Lock()
 	defer store.Unlock()
 
@@ -475,92 +797,55 @@ func (store *Store) NewPost(topicID uint32, msg string, image *Image, user, ipAd
 		return 0, errors.New("invalid topic ID")
 	}
 
-	postLongID, err := store.addNewPost(msg, image, user, ipAddr, topic, sage)
-	if err == errTooManyPosts {
-		var p buffer
-		if err = store.append(p.WriteByte(OP_LOCK).WriteUInt32(topicID).Bytes()); err == nil {
-			topic.Locked = true
+	for topic.Locked && topic.ContinuedBy > 0 {
+		if topic = store.topicByIDUnlocked(topic.ContinuedBy); topic == nil {
+			return 0, errors.New("continuation is not live")
 		}
 	}
-	return postLongID, err
-}
 
-func (store *Store) GetPostsBy(q [8]byte, qtext string, max int, timeout int64) ([]Post, int) {
-	store.RLock()
-	defer store.RUnlock()
-
-	var m []uint32
-	res, total := make([]Post, 0), 0
-
-	search := func(topic *Topic) {
-		if len(m) > 0 && len(topic.Posts) > 0 {
-			if r, _ := stringCompare(topic.Subject, "", m); r {
-				if total++; total <= max {
-					res = append(res, topic.Posts[0])
-				}
-				return
-			}
-		}
+	if topic.Locked {
+		return 0, ErrTopicLocked
+	}
 
-		q2 := topic.Posts[0].aes128(q)
-		for _, post := range topic.Posts {
-			if len(m) > 0 {
-				if r, _ := stringCompare(post.Message, "", m); r {
-					if total++; total <= max {
-						res = append(res, post)
-					}
-				}
-			} else if post.ip == q2 || post.user == q2 {
-				if total++; total <= max {
-					res = append(res, post)
-				}
-			}
+	if limit < 0 || limit > 4000 {
+		limit = 4000
+	}
 
-			if len(m) > 0 && total > max {
-				return
+	if limit == 0 || len(topic.Posts) < limit {
+		postLongID, err := store.addNewPost(msg, image, user, ipAddr, topic, sage, nil)
+		if err == errTooManyPosts {
+			var p buffer
+			if store.append(p.WriteByte(OP_LOCK).WriteUInt32(topic.ID).Bytes()) == nil {
+				topic.Locked = true
 			}
 		}
+		return postLongID, err
 	}
 
-	if strings.HasPrefix(qtext, ">>") {
-		idx := strings.Index(qtext, " ")
-		if idx == -1 {
-			return res, 0
-		}
-		longID, _ := strconv.ParseUint(qtext[2:idx], 10, 64)
-		topicID, _ := SplitID(longID)
-		topic := store.topicByIDUnlocked(uint32(topicID))
-		if topic == nil {
-			return res, 0
-		}
-		_, m = stringCompare("", qtext[idx+1:], nil)
-		if len(m) == 0 {
-			return res, 0
-		}
-		search(topic)
-		return res, total
+	if store.topicsCount == math.MaxUint32 {
+		return 0, fmt.Errorf("that day finally come")
 	}
 
-	if strings.HasPrefix(qtext, "!!") {
-		for topic := store.rootTopic.Next; topic != store.endTopic; topic = topic.Next {
-			if strings.HasPrefix(topic.Subject, qtext) {
-				if total++; total <= max {
-					res = append(res, topic.Posts[0])
-					continue
-				}
-				break
-			}
-		}
-		return res, total
+	next := &Topic{
+		ID:      store.topicsCount + 1,
+		Subject: continuedSubject(topic),
+		Board:   topic.Board,
+		Posts:   make([]Post, 0),
+		store:   store,
 	}
 
-	_, m = stringCompare("", qtext, nil)
-	start := time.Now().UnixNano()
-	for topic := store.rootTopic.Next; topic != store.endTopic; topic = topic.Next {
-		if time.Now().UnixNano()-start > timeout {
-			break
-		}
-		search(topic)
+	// the new topic and its link are written at once, so a crash can't leave them apart
+	var p buffer
+	p.WriteByte(OP_CONTINUE).WriteUInt32(topic.ID).WriteUInt32(next.ID)
+	p.WriteByte(OP_LOCK).WriteUInt32(topic.ID)
+	postLongID, err := store.addNewPost(msg, image, user, ipAddr, next, sage, p.Bytes())
+	if err != nil {
+		return 0, err
 	}
-	return res, total
+	store.topicsCount++
+	store.LiveTopicsNum++
+	store.topics[next.ID] = next
+	topic.ContinuedBy, next.ContinuedFrom = next.ID, topic.ID
+	topic.Locked = true
+	return postLongID, nil
 }
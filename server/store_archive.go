@@ -0,0 +1,552 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// archivedPost is what the archive index keeps of a post, messages stay in archive files
+type archivedPost struct {
+	ID        uint16
+	CreatedAt uint32
+	Status    byte
+	Image     string  // the path, empty if there is none
+	user      [8]byte // encrypted as in the archive file
+	ip        [8]byte
+}
+
+type archivedTopic struct {
+	topic *Topic // without posts, used to match and decrypt
+	posts []archivedPost
+	image *Image // the first image
+}
+
+// archiveIndex maps bigrams of archived posts to their long IDs, it is saved in archive/index
+// as archiveIndexMagic and length-prefixed records, one per archived topic, archiveTopic appends to it.
+// A missing or outdated file is rebuilt from the archive tree.
+type archiveIndex struct {
+	sync.RWMutex
+	postings   map[uint32][]uint64
+	topics     map[uint32]*archivedTopic
+	sorted     []uint32 // IDs of topics, ascending
+	rebuilding bool
+	pending    [][]byte // records added while rebuilding
+}
+
+// archiveIndexMagic is changed whenever the record format changes
+const archiveIndexMagic = "fai\x02"
+
+var errArchiveIndexOutdated = fmt.Errorf("outdated archive index")
+
+func newArchiveIndex() *archiveIndex {
+	return &archiveIndex{
+		postings: make(map[uint32][]uint64),
+		topics:   make(map[uint32]*archivedTopic),
+	}
+}
+
+func (store *Store) archiveIndexPath() string {
+	return filepath.Join(filepath.Dir(store.dataFilePath), "archive", "index")
+}
+
+// archiveRecord marshals the topic into a record of the archive index
+func archiveRecord(t *Topic) []byte {
+	modifiedAt := t.ModifiedAt
+	if modifiedAt < t.CreatedAt {
+		// topics without replies
+		modifiedAt = t.CreatedAt
+	}
+
+	p := buffer{utf8: true}
+	p.WriteUInt32(t.ID).WriteUInt32(t.CreatedAt).WriteUInt32(modifiedAt).WriteString(t.Subject).WriteString(t.Board)
+	p.WriteByte(byte(len(t.Tags)))
+	for _, tag := range t.Tags {
+		p.WriteString(tag)
+	}
+
+	var image *Image
+	for i := range t.Posts {
+		if post := &t.Posts[i]; post.Image != nil && !post.IsDeleted() && !post.IsMoved() {
+			image = post.Image
+			break
+		}
+	}
+	if p.WriteBool(image != nil); image != nil {
+		p.WriteString(image.Path).WriteString(image.Name).WriteUInt32(image.Size).WriteUInt16(image.X).WriteUInt16(image.Y)
+	}
+
+	p.WriteUInt16(uint16(len(t.Posts)))
+	for i := range t.Posts {
+		post := &t.Posts[i]
+		p.WriteUInt16(post.ID).WriteUInt32(post.CreatedAt).WriteByte(post.Status).WriteString(imagePath(post))
+		p.Write8Bytes(post.user).Write8Bytes(post.ip)
+
+		var grams []uint32
+		if !post.IsDeleted() && !post.IsMoved() {
+			grams = bigrams(postText(post), 0)
+		}
+		p.WriteUInt32(uint32(len(grams)))
+		for _, x := range grams {
+			p.WriteUInt32(x)
+		}
+	}
+
+	buf := make([]byte, 4, 4+len(p.Bytes()))
+	binary.BigEndian.PutUint32(buf, uint32(len(p.Bytes())))
+	return append(buf, p.Bytes()...)
+}
+
+// add parses a record without its length prefix, an existing topic with the same ID is replaced,
+// a record of only the topic ID removes the topic, see unindexArchived
+func (idx *archiveIndex) add(store *Store, rec []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = io.ErrUnexpectedEOF
+		}
+	}()
+
+	if len(rec) == 4 {
+		idx.removeTopic(binary.BigEndian.Uint32(rec))
+		return nil
+	}
+
+	r := &buffer{utf8: true}
+	r.SetReader(bytes.NewReader(rec))
+	must := func(err error) { panicif(err != nil, err) }
+
+	t := &Topic{store: store, Archived: true}
+	var err1 error
+	t.ID, err1 = r.ReadUInt32()
+	must(err1)
+	t.CreatedAt, err1 = r.ReadUInt32()
+	must(err1)
+	t.ModifiedAt, err1 = r.ReadUInt32()
+	must(err1)
+	t.Subject, err1 = r.ReadString()
+	must(err1)
+	t.Board, err1 = r.ReadString()
+	must(err1)
+	n, err1 := r.ReadByte()
+	must(err1)
+	for i := byte(0); i < n; i++ {
+		tag, err := r.ReadString()
+		must(err)
+		t.Tags = append(t.Tags, tag)
+	}
+
+	at := &archivedTopic{topic: t}
+	hasImage, err1 := r.ReadBool()
+	must(err1)
+	if hasImage {
+		img := &Image{}
+		img.Path, err1 = r.ReadString()
+		must(err1)
+		img.Name, err1 = r.ReadString()
+		must(err1)
+		img.Size, err1 = r.ReadUInt32()
+		must(err1)
+		img.X, err1 = r.ReadUInt16()
+		must(err1)
+		img.Y, err1 = r.ReadUInt16()
+		must(err1)
+		at.image = img
+	}
+
+	np, err1 := r.ReadUInt16()
+	must(err1)
+	at.posts = make([]archivedPost, np)
+	grams := make([][]uint32, np)
+	for i := range at.posts {
+		p := &at.posts[i]
+		p.ID, err1 = r.ReadUInt16()
+		must(err1)
+		p.CreatedAt, err1 = r.ReadUInt32()
+		must(err1)
+		p.Status, err1 = r.ReadByte()
+		must(err1)
+		p.Image, err1 = r.ReadString()
+		must(err1)
+		p.user, err1 = r.Read8Bytes()
+		must(err1)
+		p.ip, err1 = r.Read8Bytes()
+		must(err1)
+		ng, err := r.ReadUInt32()
+		must(err)
+		grams[i] = make([]uint32, ng)
+		for j := range grams[i] {
+			grams[i][j], err = r.ReadUInt32()
+			must(err)
+		}
+	}
+
+	if idx.topics[t.ID] != nil {
+		idx.removeTopic(t.ID)
+	}
+	idx.topics[t.ID] = at
+	i := sort.Search(len(idx.sorted), func(i int) bool { return idx.sorted[i] >= t.ID })
+	idx.sorted = append(idx.sorted, 0)
+	copy(idx.sorted[i+1:], idx.sorted[i:])
+	idx.sorted[i] = t.ID
+	for i, g := range grams {
+		id := LongID(t.ID, at.posts[i].ID)
+		for _, x := range g {
+			idx.postings[x] = append(idx.postings[x], id)
+		}
+	}
+	return nil
+}
+
+// imagePath returns the path of the post's image, or an empty string
+func imagePath(p *Post) string {
+	if p.Image == nil {
+		return ""
+	}
+	return p.Image.Path
+}
+
+// removeTopic scans all postings, it is only used when a topic is unarchived or archived again
+func (idx *archiveIndex) removeTopic(topicID uint32) {
+	delete(idx.topics, topicID)
+	if i := sort.Search(len(idx.sorted), func(i int) bool { return idx.sorted[i] >= topicID }); i < len(idx.sorted) && idx.sorted[i] == topicID {
+		idx.sorted = append(idx.sorted[:i], idx.sorted[i+1:]...)
+	}
+	for x, ids := range idx.postings {
+		res := ids[:0]
+		for _, id := range ids {
+			if tid, _ := SplitID(id); tid != topicID {
+				res = append(res, id)
+			}
+		}
+		if len(res) == 0 {
+			delete(idx.postings, x)
+		} else {
+			idx.postings[x] = res
+		}
+	}
+}
+
+// post returns a Post without message for matching
+func (at *archivedTopic) post(i int) *Post {
+	ap := &at.posts[i]
+	p := &Post{ID: ap.ID, CreatedAt: ap.CreatedAt, Status: ap.Status, user: ap.user, ip: ap.ip, Topic: at.topic}
+	if ap.Image != "" {
+		p.Image = &Image{Path: ap.Image}
+	}
+	return p
+}
+
+// indexArchived appends the archived topic to the archive index, the caller should hold the lock
+func (store *Store) indexArchived(t *Topic) error {
+	if store.archive == nil {
+		return nil
+	}
+	return store.appendArchiveRecord(archiveRecord(t))
+}
+
+// unindexArchived removes the unarchived topic from the archive index
+func (store *Store) unindexArchived(topicID uint32) error {
+	if store.archive == nil {
+		return nil
+	}
+	rec := make([]byte, 8)
+	binary.BigEndian.PutUint32(rec, 4)
+	binary.BigEndian.PutUint32(rec[4:], topicID)
+	return store.appendArchiveRecord(rec)
+}
+
+func (store *Store) appendArchiveRecord(rec []byte) error {
+	idx := store.archive
+	idx.Lock()
+	defer idx.Unlock()
+
+	if idx.rebuilding {
+		idx.pending = append(idx.pending, rec)
+	} else {
+		f, err := os.OpenFile(store.archiveIndexPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0755)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if fi, err := f.Stat(); err != nil {
+			return err
+		} else if fi.Size() == 0 {
+			if _, err := f.Write([]byte(archiveIndexMagic)); err != nil {
+				return err
+			}
+		}
+		if _, err := f.Write(rec); err != nil {
+			return err
+		}
+	}
+	return idx.add(store, rec[4:])
+}
+
+// loadArchiveIndex reads archive/index, a broken tail is truncated, it returns os.ErrNotExist if there is no such file,
+// or errArchiveIndexOutdated if the file was written in another format
+func (store *Store) loadArchiveIndex() error {
+	store.archive = newArchiveIndex()
+
+	path := store.archiveIndexPath()
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReaderSize(f, 1024*1024)
+	good := int64(len(archiveIndexMagic))
+	magic := make([]byte, good)
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != archiveIndexMagic {
+		return errArchiveIndexOutdated
+	}
+	for hdr := make([]byte, 4); ; {
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			break
+		}
+		rec := make([]byte, binary.BigEndian.Uint32(hdr))
+		if _, err := io.ReadFull(r, rec); err != nil {
+			break
+		}
+		if store.archive.add(store, rec) != nil {
+			break
+		}
+		good += int64(4 + len(rec))
+	}
+
+	if fi, err := f.Stat(); err == nil && fi.Size() > good {
+		return os.Truncate(path, good)
+	}
+	return nil
+}
+
+// RebuildArchiveIndex walks the archive tree and rewrites archive/index, topics archived meanwhile are kept.
+// It returns the number of topics indexed.
+func (store *Store) RebuildArchiveIndex() (int, error) {
+	idx := store.archive
+	idx.Lock()
+	if idx.rebuilding {
+		idx.Unlock()
+		return 0, fmt.Errorf("the archive index is being rebuilt")
+	}
+	idx.rebuilding = true
+	idx.Unlock()
+
+	path := store.archiveIndexPath()
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	w.WriteString(archiveIndexMagic)
+	nidx, n := newArchiveIndex(), 0
+	err = filepath.Walk(filepath.Dir(path), func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		id, err := strconv.ParseUint(info.Name(), 10, 32)
+		if err != nil || p != store.buildArchivePath(uint32(id)) {
+			// not an archived topic
+			return nil
+		}
+		t, err := store.loadArchived(uint32(id))
+		if err != nil {
+			return nil
+		}
+		rec := archiveRecord(t)
+		if _, err := w.Write(rec); err != nil {
+			return err
+		}
+		n++
+		return nidx.add(store, rec[4:])
+	})
+
+	idx.Lock()
+	defer idx.Unlock()
+	idx.rebuilding = false
+
+	for _, rec := range idx.pending {
+		if err == nil {
+			_, err = w.Write(rec)
+		}
+		nidx.add(store, rec[4:])
+	}
+	idx.pending = nil
+
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return 0, err
+	}
+	idx.postings, idx.topics, idx.sorted = nidx.postings, nidx.topics, nidx.sorted
+	return n, nil
+}
+
+// ArchivedNum returns the number of topics in the archive index
+func (store *Store) ArchivedNum() int {
+	if store.archive == nil {
+		return 0
+	}
+	store.archive.RLock()
+	defer store.archive.RUnlock()
+	return len(store.archive.topics)
+}
+
+// ArchivedTopic is an entry of the archive browser, Posts of the Topic are not loaded
+type ArchivedTopic struct {
+	Topic
+	PostsNum int
+	Image    *Image // the first image
+}
+
+// ArchiveMonth is a month in the archive browser, topics are grouped by when they were created
+type ArchiveMonth struct {
+	Month string // 2006-01
+	Count int
+}
+
+func archiveMonth(createdAt uint32) string {
+	return time.Unix(int64(createdAt), 0).Format("2006-01")
+}
+
+// ArchiveMonths returns months having archived topics, newest first
+func (store *Store) ArchiveMonths() []ArchiveMonth {
+	res := []ArchiveMonth{}
+	if store.archive == nil {
+		return res
+	}
+	store.archive.RLock()
+	defer store.archive.RUnlock()
+
+	counts := map[string]int{}
+	for _, at := range store.archive.topics {
+		counts[archiveMonth(at.topic.CreatedAt)]++
+	}
+	for m, n := range counts {
+		res = append(res, ArchiveMonth{Month: m, Count: n})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Month > res[j].Month })
+	return res
+}
+
+// ArchivedTopics returns archived topics created in month (all if empty) from start, newest first, and the number of all of them
+func (store *Store) ArchivedTopics(month string, start, length int) ([]ArchivedTopic, int) {
+	res := []ArchivedTopic{}
+	if store.archive == nil {
+		return res, 0
+	}
+	store.archive.RLock()
+	defer store.archive.RUnlock()
+
+	n := 0
+	for i := len(store.archive.sorted) - 1; i >= 0; i-- {
+		at := store.archive.topics[store.archive.sorted[i]]
+		if month != "" && archiveMonth(at.topic.CreatedAt) != month {
+			continue
+		}
+		if n >= start && n < start+length {
+			res = append(res, ArchivedTopic{Topic: *at.topic, PostsNum: len(at.posts), Image: at.image})
+		}
+		n++
+	}
+	return res, n
+}
+
+// loadArchived loads an archived topic with the cipher of the store
+func (store *Store) loadArchived(topicID uint32) (*Topic, error) {
+	t, err := store.loadTopicFile(store.buildArchivePath(topicID), topicID)
+	if err != nil {
+		return nil, err
+	}
+	t.Archived = true
+	return t, nil
+}
+
+// loadTopicFile loads a topic saved by saveTopic
+func (store *Store) loadTopicFile(path string, topicID uint32) (*Topic, error) {
+	s := newDummyStore([16]byte{})
+	s.block = store.block
+	if err := s.loadDB(path, true, nil); err != nil {
+		return nil, err
+	}
+	t := s.topics[topicID]
+	if t == nil {
+		return nil, os.ErrNotExist
+	}
+	return t, nil
+}
+
+// searchArchived returns long IDs of archived posts matching q and m, see Search,
+// topics are loaded from disk only if q has phrases, newest first for up to timeout nanoseconds
+func (store *Store) searchArchived(q *Query, m []uint32, loaded map[uint32]*Topic, timeout int64) []uint64 {
+	idx := store.archive
+	if idx == nil || !q.indexed() {
+		return nil
+	}
+
+	idx.RLock()
+	counts := map[uint64]int{}
+	for _, x := range m {
+		for _, id := range idx.postings[x] {
+			counts[id]++
+		}
+	}
+
+	ids := []uint64{}
+	for id, n := range counts {
+		if n < len(m)/2+1 {
+			continue
+		}
+		tid, pid := SplitID(id)
+		at := idx.topics[tid]
+		if at == nil || int(pid) > len(at.posts) || at.posts[pid-1].ID != pid {
+			continue
+		}
+		if p := at.post(int(pid) - 1); q.matchMeta(p) {
+			ids = append(ids, id)
+		}
+	}
+	idx.RUnlock()
+
+	if len(q.Phrases) == 0 {
+		return ids
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] > ids[j] })
+	deadline := time.Now().UnixNano() + timeout
+
+	res := ids[:0]
+	for _, id := range ids {
+		tid, pid := SplitID(id)
+		t := loaded[tid]
+		if t == nil {
+			if time.Now().UnixNano() >= deadline {
+				continue
+			}
+			var err error
+			if t, err = store.loadArchived(tid); err != nil {
+				continue
+			}
+			loaded[tid] = t
+		}
+		if int(pid) <= len(t.Posts) && q.matchPhrases(&t.Posts[pid-1]) {
+			res = append(res, id)
+		}
+	}
+	return res
+}
@@ -0,0 +1,103 @@
+package server
+
+// countImages counts posts referring to each image, in live topics, the archive and the trash.
+// Deleted posts don't count, images are named by their contents so posts may share one.
+// Until it's done on boot store.images is nil and no image is reported to be unused.
+func (store *Store) countImages() {
+	store.Lock()
+	defer store.Unlock()
+
+	images := map[string]int{}
+	count := func(p *Post) {
+		if p.Image != nil && !p.IsDeleted() && !p.IsMoved() {
+			images[p.Image.Path]++
+		}
+	}
+
+	for t := store.rootTopic.Next; t != store.endTopic; t = t.Next {
+		for i := range t.Posts {
+			count(&t.Posts[i])
+		}
+	}
+
+	if idx := store.archive; idx != nil {
+		idx.RLock()
+		for _, at := range idx.topics {
+			for i := range at.posts {
+				count(at.post(i))
+			}
+		}
+		idx.RUnlock()
+	}
+
+	trash, _ := store.trashedTopics()
+	for t := range trash {
+		for i := range t.Posts {
+			count(&t.Posts[i])
+		}
+	}
+	store.images = images
+}
+
+// acquireImage adds a reference to the image, the caller should hold the lock
+func (store *Store) acquireImage(path string) {
+	if store.images != nil {
+		store.images[path]++
+	}
+}
+
+// releaseImage removes a reference to the image, it returns true if no post refers to it any more,
+// the caller should hold the lock
+func (store *Store) releaseImage(path string) bool {
+	if store.images == nil {
+		return false
+	}
+	if store.images[path]--; store.images[path] > 0 {
+		return false
+	}
+	delete(store.images, path)
+	return store.imageHolds[path] == 0
+}
+
+// HoldImage calls place to put the uploaded image in place, then keeps it from being removed
+// until release is called, so posts can refer to it in between
+func (store *Store) HoldImage(path string, place func() error) (release func(), err error) {
+	store.Lock()
+	defer store.Unlock()
+
+	if err := place(); err != nil {
+		return nil, err
+	}
+	if store.imageHolds == nil {
+		store.imageHolds = map[string]int{}
+	}
+	store.imageHolds[path]++
+
+	return func() {
+		store.Lock()
+		defer store.Unlock()
+		if store.imageHolds[path]--; store.imageHolds[path] == 0 {
+			delete(store.imageHolds, path)
+		}
+	}, nil
+}
+
+// ImageRefs returns the number of posts referring to the image, or -1 if images are not counted yet
+func (store *Store) ImageRefs(path string) int {
+	store.RLock()
+	defer store.RUnlock()
+	if store.images == nil {
+		return -1
+	}
+	return store.images[path]
+}
+
+// releaseTopicImages releases images of the topic which is about to be removed for good,
+// onImageDelete is called with images no longer referred to
+func (store *Store) releaseTopicImages(t *Topic, onImageDelete func(*Image)) {
+	for i := range t.Posts {
+		if p := &t.Posts[i]; p.Image != nil && !p.IsDeleted() && !p.IsMoved() && store.releaseImage(p.Image.Path) {
+			onImageDelete(p.Image)
+		}
+	}
+}
@@ -6,7 +6,9 @@ import (
 	"encoding/base64"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -45,7 +47,7 @@ func parseTopic(r *buffer, store *Store) *Topic {
 	}
 }
 
-func parseImage(r *buffer, topicIDToTopic map[uint32]*Topic) {
+func parseImage(r *buffer, topicIDToTopic map[uint32]*Topic) *Post {
 	topicID, err := r.ReadUInt32()
 	panicif(err != nil, "invalid topic ID")
 
@@ -80,9 +82,10 @@ func parseImage(r *buffer, topicIDToTopic map[uint32]*Topic) {
 		X:    x,
 		Y:    y,
 	}
+	return p
 }
 
-func parseNSFW(r *buffer, topicIDToTopic map[uint32]*Topic) {
+func parseNSFW(r *buffer, topicIDToTopic map[uint32]*Topic) *Post {
 	topicID, err := r.ReadUInt32()
 	panicif(err != nil, "invalid topic ID")
 
@@ -94,6 +97,7 @@ func parseNSFW(r *buffer, topicIDToTopic map[uint32]*Topic) {
 
 	p := &t.Posts[id-1]
 	p.T_InvertStatus(POST_T_ISNSFW)
+	return p
 }
 
 func parsePost(r *buffer, topicIDToTopic map[uint32]*Topic) Post {
@@ -136,6 +140,18 @@ func parsePost(r *buffer, topicIDToTopic map[uint32]*Topic) Post {
 	}
 }
 
+// readHeader returns the committed size and the flags of a data file
+func readHeader(f io.ReaderAt) (int64, byte, error) {
+	header := [16]byte{}
+	if _, err := f.ReadAt(header[:], 0); err != nil {
+		return 0, 0, err
+	}
+	if header[0] != 'z' || header[1] != 'z' || header[2] != 'z' || header[3]&^(HEADER_SLOT|HEADER_UTF8) != 0 {
+		return 0, 0, fmt.Errorf("invalid header")
+	}
+	return int64(binary.BigEndian.Uint64(header[2+(header[3]&HEADER_SLOT)*6:]) & 0xffffffffffff), header[3], nil
+}
+
 func (store *Store) loadDB(path string, slient bool, onload func(*Store)) (err error) {
 	fh, err := os.Open(path)
 	if err != nil {
@@ -143,7 +159,6 @@ func (store *Store) loadDB(path string, slient bool, onload func(*Store)) (err e
 	}
 	defer fh.Close()
 
-	topicIDToTopic := make(map[uint32]*Topic)
 	start := time.Now()
 
 	defer func() {
@@ -155,17 +170,14 @@ func (store *Store) loadDB(path string, slient bool, onload func(*Store)) (err e
 		}
 	}()
 
-	header := [16]byte{}
-	if n, err := fh.Read(header[:]); err != nil || n != 16 ||
-		header[0] != 'z' || header[1] != 'z' || header[2] != 'z' || header[3] > 1 {
-		panic("invalid header")
-	}
+	fsize, flag, err := readHeader(fh)
+	panicif(err != nil || fsize < 16, "invalid header")
 
-	fsize := int64(binary.BigEndian.Uint64(header[2+header[3]*6:]) & 0xffffffffffff)
 	store.ptr = 16
+	store.utf8 = flag&HEADER_UTF8 > 0
 
-	r := &buffer{}
-	r.SetReader(bufio.NewReaderSize(fh, 1024*1024*10))
+	r := &buffer{utf8: store.utf8}
+	r.SetReader(bufio.NewReaderSize(io.NewSectionReader(fh, 16, fsize-16), 1024*1024*10))
 	r.pos = store.ptr
 
 	print := func(f string, args ...interface{}) {
@@ -175,6 +187,10 @@ func (store *Store) loadDB(path string, slient bool, onload func(*Store)) (err e
 		}
 	}
 
+	if !store.utf8 {
+		print("legacy string format, non-BMP characters will be lost, snapshot the store to upgrade\n")
+	}
+
 	var ceil uintptr
 	for {
 		panicif(r.pos > fsize, "invalid DB size")
@@ -197,90 +213,9 @@ func (store *Store) loadDB(path string, slient bool, onload func(*Store)) (err e
 			break
 		}
 
-		switch op {
-		case OP_TOPIC:
-			t := parseTopic(r, store)
-			// here the topic is moved to the front
-			// if it is a saged topic, this OP_TOPIC will be followed by a saged OP_POST
-			store.moveTopicToFront(t)
-			store.topicsCount++
-			store.LiveTopicsNum++
-			panicif(topicIDToTopic[t.ID] != nil, "topic %d already existed", t.ID)
-			topicIDToTopic[t.ID] = t
-		case OP_TOPICNUM:
-			num, err := r.ReadUInt32()
-			panicif(err != nil, "invalid new topics counter")
-			print("topic counter updated, old: %d, new: %d\n", store.topicsCount, num)
-			store.topicsCount = num
-		case OP_POST:
-			post := parsePost(r, topicIDToTopic)
-			t := post.Topic
-			t.Posts = append(t.Posts, post)
-			if len(t.Posts) == 1 {
-				t.CreatedAt = post.CreatedAt
-			} else {
-				t.ModifiedAt = post.CreatedAt
-			}
-			if !post.IsSaged() {
-				store.moveTopicToFront(t)
-			}
-		case OP_APPEND:
-			post, err := findPost(r, topicIDToTopic)
-			panicif(err != nil, err)
-			msg, err := r.ReadString()
-			panicif(err != nil, err)
-			post.Message += msg
-		case OP_IMAGE:
-			parseImage(r, topicIDToTopic)
-		case OP_NSFW:
-			parseNSFW(r, topicIDToTopic)
-		case OP_DELETE:
-			post, err := findPost(r, topicIDToTopic)
-			panicif(err != nil, err)
-			post.InvertStatus(POST_ISDELETE)
-		case OP_BLOCK:
-			str, err := r.Read8Bytes()
-			panicif(err != nil, "invalid object to block")
-			store.markBlockedOrUnblocked(str)
-		case OP_STICKY, OP_ARCHIVE, OP_LOCK, OP_PURGE, OP_FREEREPLY, OP_SAGE:
-			topicID, err := r.ReadUInt32()
-			panicif(err != nil, err)
-
-			t := topicIDToTopic[topicID]
-			panicif(t == nil, "can't find the topic to '%s': %d", string(op), topicID)
-
-			switch op {
-			case OP_STICKY:
-				if t.Sticky = !t.Sticky; t.Sticky {
-					store.moveTopicToFront(t)
-				}
-			case OP_LOCK:
-				t.Locked = !t.Locked
-			case OP_FREEREPLY:
-				t.FreeReply = !t.FreeReply
-			case OP_SAGE:
-				t.Saged = !t.Saged
-			case OP_ARCHIVE, OP_PURGE:
-				t.Prev.Next = t.Next
-				t.Next.Prev = t.Prev
-				store.LiveTopicsNum--
-				delete(topicIDToTopic, t.ID)
-			}
-		case OP_CONFIG:
-			cs, err := r.ReadString()
-			panicif(err != nil, err)
-			store.configStr = cs
-		case OP_MAXTOPICS:
-			m, err := r.ReadUInt32()
-			panicif(err != nil, err)
-			print("max live topics updated, old: %d, new: %d\n", store.maxLiveTopics, m)
-			store.maxLiveTopics = int(m)
-		// if the new maxLiveTopics is smaller,
-		// then multiple OP_ARCHIVEs shall be presented afterwards
-		case OP_NOP:
-			// do nothing
-		default:
-			panicif(true, "unexpected line type: %s(%x)", string(op), op)
+		res := store.applyOp(op, r, print)
+		if store.onReplay != nil && !store.onReplay(store.ptr, op, res) {
+			break
 		}
 	}
 
@@ -297,12 +232,228 @@ func (store *Store) loadDB(path string, slient bool, onload func(*Store)) (err e
 	return nil
 }
 
+// opResult is what applyOp has replayed
+type opResult struct {
+	topic *Topic
+	post  *Post
+	str   string  // appended message, config
+	term  [8]byte // blocked IP or user
+	num   uint32  // topics counter, max live topics
+	from  uint64  // long ID before moving
+	num64 uint64  // long ID after redirecting
+}
+
+// applyOp replays a single op read from r, it panics on invalid data
+func (store *Store) applyOp(op byte, r *buffer, print func(string, ...interface{})) (res opResult) {
+	topicIDToTopic := store.topics
+
+	switch op {
+	case OP_TOPIC:
+		t := parseTopic(r, store)
+		panicif(topicIDToTopic[t.ID] != nil, "topic %d already existed", t.ID)
+		// here the topic is moved to the front
+		// if it is a saged topic, this OP_TOPIC will be followed by a saged OP_POST
+		store.moveTopicToFront(t)
+		store.topicsCount++
+		store.LiveTopicsNum++
+		topicIDToTopic[t.ID] = t
+		res.topic = t
+	case OP_TOPICNUM:
+		num, err := r.ReadUInt32()
+		panicif(err != nil, "invalid new topics counter")
+		print("topic counter updated, old: %d, new: %d\n", store.topicsCount, num)
+		store.topicsCount = num
+		res.num = num
+	case OP_POST:
+		post := parsePost(r, topicIDToTopic)
+		t := post.Topic
+		t.Posts = append(t.Posts, post)
+		if len(t.Posts) == 1 {
+			t.CreatedAt = post.CreatedAt
+		} else {
+			t.ModifiedAt = post.CreatedAt
+		}
+		if !post.IsSaged() {
+			store.moveTopicToFront(t)
+		}
+		res.topic, res.post = t, &t.Posts[len(t.Posts)-1]
+		store.indexPost(res.post)
+	case OP_APPEND:
+		post, err := findPost(r, topicIDToTopic)
+		panicif(err != nil, err)
+		msg, err := r.ReadString()
+		panicif(err != nil, err)
+		store.unindexPost(post)
+		post.Message += msg
+		store.indexPost(post)
+		res.topic, res.post, res.str = post.Topic, post, msg
+	case OP_EDIT:
+		post, err := findPost(r, topicIDToTopic)
+		panicif(err != nil, err)
+		editedAt, err := r.ReadUInt32()
+		panicif(err != nil, "invalid timestamp")
+		msg, err := r.ReadString()
+		panicif(err != nil, err)
+		store.unindexPost(post)
+		post.edit(msg, editedAt)
+		store.indexPost(post)
+		res.topic, res.post, res.str = post.Topic, post, msg
+	case OP_MOVE:
+		post, err := findPost(r, topicIDToTopic)
+		panicif(err != nil, err)
+		dstID, err := r.ReadUInt32()
+		panicif(err != nil, "invalid topic ID")
+		dst := topicIDToTopic[dstID]
+		panicif(dst == nil, "can't find the topic to move to: %d", dstID)
+		panicif(post.IsMoved() || post.Topic == dst || len(dst.Posts) >= 4000, "can't move post %d to %d", post.LongID(), dstID)
+		res.from = post.LongID()
+		res.post = store.movePost(post, dst)
+		res.topic = dst
+	case OP_REDIRECT:
+		from, err1 := r.ReadUInt64()
+		to, err2 := r.ReadUInt64()
+		panicif(err1 != nil || err2 != nil, "invalid redirect")
+		store.redirects[from] = to
+		res.from, res.num64 = from, to
+	case OP_BOARD:
+		topicID, err := r.ReadUInt32()
+		panicif(err != nil, err)
+		board, err := r.ReadString()
+		panicif(err != nil, err)
+		t := topicIDToTopic[topicID]
+		panicif(t == nil, "can't find the topic: %d", topicID)
+		t.Board = board
+		res.topic, res.str = t, board
+	case OP_TAG, OP_UNTAG:
+		topicID, err := r.ReadUInt32()
+		panicif(err != nil, err)
+		tag, err := r.ReadString()
+		panicif(err != nil, err)
+		t := topicIDToTopic[topicID]
+		panicif(t == nil, "can't find the topic: %d", topicID)
+		store.setTag(t, tag, op == OP_TAG)
+		res.topic, res.str = t, tag
+	case OP_CONTINUE:
+		from, err1 := r.ReadUInt32()
+		to, err2 := r.ReadUInt32()
+		panicif(err1 != nil || err2 != nil, "invalid continuation")
+		// either one may have been archived
+		if t := topicIDToTopic[to]; t != nil {
+			t.ContinuedFrom = from
+			res.topic = t
+		}
+		if t := topicIDToTopic[from]; t != nil {
+			t.ContinuedBy = to
+			res.topic = t
+		}
+		res.num = to
+	case OP_IMAGE:
+		res.post = parseImage(r, topicIDToTopic)
+		res.topic = res.post.Topic
+	case OP_NSFW:
+		res.post = parseNSFW(r, topicIDToTopic)
+		res.topic = res.post.Topic
+	case OP_DELETE:
+		post, err := findPost(r, topicIDToTopic)
+		panicif(err != nil, err)
+		store.unindexPost(post)
+		post.InvertStatus(POST_ISDELETE)
+		store.indexPost(post)
+		res.topic, res.post = post.Topic, post
+	case OP_DELIMAGE:
+		post, err := findPost(r, topicIDToTopic)
+		panicif(err != nil, err)
+		panicif(post.Image == nil, "post %d has no image", post.LongID())
+		res.str, post.Image = post.Image.Path, nil
+		res.topic, res.post = post.Topic, post
+	case OP_BLOCK:
+		str, err := r.Read8Bytes()
+		panicif(err != nil, "invalid object to block")
+		store.markBlockedOrUnblocked(str)
+		res.term = str
+	case OP_STICKY, OP_ARCHIVE, OP_LOCK, OP_PURGE, OP_FREEREPLY, OP_SAGE:
+		topicID, err := r.ReadUInt32()
+		panicif(err != nil, err)
+
+		t := topicIDToTopic[topicID]
+		panicif(t == nil, "can't find the topic to '%s': %d", string(op), topicID)
+
+		switch op {
+		case OP_STICKY:
+			if t.Sticky = !t.Sticky; t.Sticky {
+				store.moveTopicToFront(t)
+			}
+		case OP_LOCK:
+			t.Locked = !t.Locked
+		case OP_FREEREPLY:
+			t.FreeReply = !t.FreeReply
+		case OP_SAGE:
+			t.Saged = !t.Saged
+		case OP_ARCHIVE, OP_PURGE:
+			store.unlinkTopic(t)
+		}
+		res.topic = t
+	case OP_UNARCHIVE, OP_UNPURGE:
+		// followed by ops of the whole topic and an OP_NOP, see reviveTopic
+		topicID, err := r.ReadUInt32()
+		panicif(err != nil, err)
+		panicif(topicIDToTopic[topicID] != nil, "topic %d is already live", topicID)
+
+		for {
+			op, err := r.ReadByte()
+			panicif(err != nil, err)
+			if op == OP_NOP {
+				break
+			}
+			switch op {
+			case OP_TOPIC, OP_BOARD, OP_TAG, OP_POST, OP_EDIT, OP_IMAGE, OP_NSFW, OP_CONTINUE,
+				OP_LOCK, OP_FREEREPLY, OP_SAGE, OP_STICKY:
+			default:
+				panicif(true, "unexpected op in the revived topic %d: %s(%x)", topicID, string(op), op)
+			}
+			x := store.applyOp(op, r, print)
+			panicif(op != OP_CONTINUE && x.topic.ID != topicID, "unexpected topic in the revived topic %d: %d", topicID, x.topic.ID)
+		}
+
+		t := topicIDToTopic[topicID]
+		panicif(t == nil || len(t.Posts) == 0, "revived topic %d has no posts", topicID)
+		// not a new topic
+		store.topicsCount--
+		res.topic = t
+	case OP_CONFIG:
+		cs, err := r.ReadString()
+		panicif(err != nil, err)
+		store.configStr = cs
+		res.str = cs
+	case OP_MAXTOPICS:
+		m, err := r.ReadUInt32()
+		panicif(err != nil, err)
+		print("max live topics updated, old: %d, new: %d\n", store.maxLiveTopics, m)
+		store.maxLiveTopics = int(m)
+		res.num = m
+	// if the new maxLiveTopics is smaller,
+	// then multiple OP_ARCHIVEs shall be presented afterwards
+	case OP_TIME:
+		ts, err := r.ReadUInt32()
+		panicif(err != nil, "invalid timestamp")
+		res.num = ts
+	case OP_NOP:
+		// do nothing
+	default:
+		panicif(true, "unexpected line type: %s(%x)", string(op), op)
+	}
+	return
+}
+
 func NewStore(path string, password [16]byte, onload func(*Store)) *Store {
 	store := &Store{
 		dataFilePath:  path,
 		rootTopic:     &Topic{},
 		endTopic:      &Topic{},
+		topics:        make(map[uint32]*Topic),
 		blocked:       make(map[[8]byte]bool),
+		redirects:     make(map[uint64]uint64),
+		tags:          make(map[string]map[uint32]bool),
 		Rand:          rand.New(),
 		maxLiveTopics: 1024,
 	}
@@ -315,17 +466,27 @@ func NewStore(path string, password [16]byte, onload func(*Store)) *Store {
 	if err != nil {
 		f, err := os.Create(store.dataFilePath)
 		panicif(err != nil, "can't create initial DB %s: %v", store.dataFilePath, err)
-		_, err = f.Write([]byte{'z', 'z', 'z', 0, 0, 0, 0, 0, 0, 0x10, 0, 0, 0, 0, 0, 0x10})
+		_, err = f.Write([]byte{'z', 'z', 'z', HEADER_UTF8, 0, 0, 0, 0, 0, 0x10, 0, 0, 0, 0, 0, 0x10})
 		panicif(err != nil, "can't write initial DB %s: %v", store.dataFilePath, err)
 		f.Close()
 	}
 	go func() {
+		if err := store.loadIndex(); err != nil && !os.IsNotExist(err) {
+			fmt.Println("rebuild the search index:", err)
+		}
+		archiveErr := store.loadArchiveIndex()
 		store.loadDB(store.dataFilePath, false, onload)
 		for topic := store.rootTopic.Next; topic != store.endTopic; topic = topic.Next {
 			panicif(0 == len(topic.Posts), "topic %d has no posts!", topic.ID)
 		}
 		store.dataFile, err = os.OpenFile(store.dataFilePath, os.O_RDWR, 0666)
 		panicif(err != nil, "can't open DB %s: %v", store.dataFilePath, err)
+
+		if _, err := os.Stat(filepath.Dir(store.archiveIndexPath())); err == nil && archiveErr != nil {
+			n, err := store.RebuildArchiveIndex()
+			fmt.Println("rebuild the archive index:", n, "topics", err)
+		}
+		store.countImages()
 	}()
 
 	if false {
@@ -367,21 +528,31 @@ func NewStore(path string, password [16]byte, onload func(*Store)) *Store {
 	return store
 }
 
-func (store *Store) LoadArchivedTopic(topicID uint32, password [16]byte) (Topic, error) {
-	path := store.buildArchivePath(uint32(topicID))
-	if _, err := os.Stat(path); err != nil {
-		return Topic{}, err
-	}
-
-	// create a dummy store to load a single topic
-	store = &Store{
+// newDummyStore creates an in-memory store which is not backed by any data file
+func newDummyStore(password [16]byte) *Store {
+	store := &Store{
 		rootTopic: &Topic{},
 		endTopic:  &Topic{},
+		topics:    make(map[uint32]*Topic),
+		blocked:   make(map[[8]byte]bool),
+		redirects: make(map[uint64]uint64),
+		tags:      make(map[string]map[uint32]bool),
 	}
 
 	store.rootTopic.Next = store.endTopic
 	store.endTopic.Prev = store.rootTopic
 	store.block, _ = aes.NewCipher(password[:])
+	return store
+}
+
+func (store *Store) LoadArchivedTopic(topicID uint32, password [16]byte) (Topic, error) {
+	path := store.buildArchivePath(uint32(topicID))
+	if _, err := os.Stat(path); err != nil {
+		return Topic{}, err
+	}
+
+	// create a dummy store to load a single topic
+	store = newDummyStore(password)
 
 	var err error
 	if err = store.loadDB(path, true, nil); err != nil {
@@ -395,54 +566,59 @@ func (store *Store) LoadArchivedTopic(topicID uint32, password [16]byte) (Topic,
 	return *store.rootTopic.Next, nil
 }
 
+// stamp writes OP_TIME of now into p
+func stamp(p *buffer) *buffer {
+	return p.WriteByte(OP_TIME).WriteUInt32(uint32(time.Now().Unix()))
+}
+
 // append writes data onto disk with WAL
 func (store *Store) append(buf []byte) error {
-	// append data uncommitted
-	_, err := store.dataFile.Seek(store.ptr, 0)
-	if err != nil {
-		return err
+	if store.IsReadOnly() {
+		return errReadOnly
 	}
-	if _, err = store.dataFile.Write(buf); err != nil {
-		return err
+
+	// ops without their own timestamps are stamped, see Restore. Buffers starting with OP_TOPIC
+	// carry their own: the first OP_POST of a new topic, or an OP_TIME written by SplitTopic
+	if op := buf[0]; op != OP_TOPIC && op != OP_POST && op != OP_EDIT && op != OP_TIME {
+		buf = append(stamp(&buffer{}).Bytes(), buf...)
 	}
-	newptr, err := store.dataFile.Seek(0, 1)
-	if err != nil {
+
+	// append data uncommitted
+	if _, err := store.dataFile.WriteAt(buf, store.ptr); err != nil {
 		return err
 	}
 
-	// start committing header
-	if _, err = store.dataFile.Seek(0, 0); err != nil {
+	newptr := store.ptr + int64(len(buf))
+	if err := commitHeader(store.dataFile, newptr); err != nil {
 		return err
 	}
+
+	// all clear
+	store.ptr = newptr
+	store.notifyAppend()
+	return nil
+}
+
+// commitHeader writes the new size into the uncommitted slot of the header and then flips the slot flag
+func commitHeader(f *os.File, size int64) error {
 	tmp := [8]byte{}
-	if _, err = store.dataFile.Read(tmp[:]); err != nil {
+	if _, err := f.ReadAt(tmp[:], 0); err != nil {
 		return err
 	}
-	flag := tmp[3]
-	binary.BigEndian.PutUint64(tmp[:], uint64(newptr))
 
-	if flag == 0 {
-		flag = 1
-		_, err = store.dataFile.Seek(10, 0)
+	flag, off := tmp[3], int64(4)
+	binary.BigEndian.PutUint64(tmp[:], uint64(size))
+
+	if flag&HEADER_SLOT == 0 {
+		flag |= HEADER_SLOT
+		off = 10
 	} else {
-		flag = 0
-		_, err = store.dataFile.Seek(4, 0)
-	}
-	if err != nil {
-		return err
+		flag &^= HEADER_SLOT
 	}
 
-	if _, err = store.dataFile.Write(tmp[2:]); err != nil {
+	if _, err := f.WriteAt(tmp[2:], off); err != nil {
 		return err
 	}
-	if _, err = store.dataFile.Seek(3, 0); err != nil {
-		return err
-	}
-	if _, err = store.dataFile.Write([]byte{flag}); err != nil {
-		return err
-	}
-
-	// all clear
-	store.ptr = newptr
-	return nil
+	_, err := f.WriteAt([]byte{flag}, 3)
+	return err
 }
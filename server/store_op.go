@@ -3,6 +3,9 @@ package server
 import (
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
 	"os"
 )
 
@@ -41,20 +44,36 @@ func (store *Store) DeletePost(u User, postLongID uint64, imageOnly bool, onImag
 		return fmt.Errorf("can't delete the post")
 	}
 
+	var p buffer
 	if imageOnly {
-		onImageDelete(post.Image)
+		img := post.Image
+		if img == nil {
+			return fmt.Errorf("post %d has no image", postLongID)
+		}
+		if err := store.append(p.WriteByte(OP_DELIMAGE).WriteUInt32(post.Topic.ID).WriteUInt16(post.ID).Bytes()); err != nil {
+			return err
+		}
+		post.Image = nil
+		if !post.IsDeleted() && store.releaseImage(img.Path) {
+			onImageDelete(img)
+		}
 		return nil
 	}
 
-	var p buffer
 	if err := store.append(p.WriteByte(OP_DELETE).WriteUInt32(post.Topic.ID).WriteUInt16(post.ID).Bytes()); err != nil {
 		return err
 	}
 
+	store.unindexPost(post)
 	post.InvertStatus(POST_ISDELETE)
+	store.indexPost(post)
 
 	if post.Image != nil {
-		onImageDelete(post.Image)
+		if !post.IsDeleted() {
+			store.acquireImage(post.Image.Path)
+		} else if store.releaseImage(post.Image.Path) {
+			onImageDelete(post.Image)
+		}
 	}
 	return nil
 }
@@ -82,61 +101,125 @@ func (store *Store) FlagPost(u User, postLongID uint64, flag byte, callback func
 }
 
 func SnapshotStore(output string, store *Store) {
+	store.RLock()
+	buf := store.marshal()
+	store.RUnlock()
+
 	os.Remove(output)
-	dst, err := os.Create(output)
+	err := ioutil.WriteFile(output, buf, 0755)
 	panicif(err != nil, "%v", err)
-	defer dst.Close()
+}
 
-	store.RLock()
-	defer store.RUnlock()
+// marshal serializes all live data into a complete data file, the caller should hold the lock
+func (store *Store) marshal() []byte {
+	// header, snapshots are always written in the UTF-8 format
+	buf := buffer{utf8: true}
+	buf.WriteByte('z').WriteByte('z').WriteByte('z').WriteByte(HEADER_UTF8).WriteUInt48(0).WriteUInt48(0)
 
-	write := func(buf []byte) {
-		_, err := dst.Write(buf)
-		panicif(err != nil, "%v", err)
+	for topic := store.endTopic.Prev; topic != store.rootTopic; topic = topic.Prev {
+		p := topic.marshal(true)
+		buf.p.Write(p.Bytes())
+		topic.marshalFlags(&buf)
 	}
 
-	// header
-	write([]byte{'z', 'z', 'z', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	buf.WriteByte(OP_TOPICNUM).WriteUInt32(store.topicsCount)
 
-	for topic := store.endTopic.Prev; topic != store.rootTopic; topic = topic.Prev {
-		p := topic.marshal()
-		write(p.Bytes())
+	for k := range store.blocked {
+		buf.WriteByte(OP_BLOCK).Write8Bytes(k)
+	}
 
-		if topic.Locked {
-			write(p.Reset().WriteByte(OP_LOCK).WriteUInt32(topic.ID).Bytes())
-		}
+	for from, to := range store.redirects {
+		buf.WriteByte(OP_REDIRECT).WriteUInt64(from).WriteUInt64(to)
+	}
 
-		if topic.FreeReply {
-			write(p.Reset().WriteByte(OP_FREEREPLY).WriteUInt32(topic.ID).Bytes())
-		}
+	buf.WriteByte(OP_CONFIG).WriteString(store.configStr)
+	buf.WriteByte(OP_MAXTOPICS).WriteUInt32(uint32(store.maxLiveTopics))
 
-		if topic.Saged {
-			write(p.Reset().WriteByte(OP_SAGE).WriteUInt32(topic.ID).Bytes())
-		}
+	res := buf.Bytes()
+	copy(res[4:], (&buffer{}).WriteUInt48(uint64(len(res))).Bytes())
+	return res
+}
 
-		if topic.Sticky {
-			// TODO: should be written in ID asc order
-			write(p.Reset().WriteByte(OP_STICKY).WriteUInt32(topic.ID).Bytes())
-		}
+// Compact rewrites the data file into a snapshot while the store keeps serving,
+// ops appended during the rewrite will be copied to the new file before the swap
+func (store *Store) Compact() (int64, int64, error) {
+	if store.IsReadOnly() {
+		// offsets must stay the same as the primary
+		return 0, 0, errReadOnly
 	}
 
-	var p buffer
-	write(p.WriteByte(OP_TOPICNUM).WriteUInt32(store.topicsCount).Bytes())
+	store.configLock.RLock()
+	store.RLock()
+	buf, from := store.marshal(), store.ptr
+	store.RUnlock()
+	store.configLock.RUnlock()
 
-	for k := range store.blocked {
-		write(p.Reset().WriteByte(OP_BLOCK).Write8Bytes(k).Bytes())
+	path := store.dataFilePath + ".compact"
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return 0, 0, err
 	}
 
-	write(p.Reset().WriteByte(OP_CONFIG).WriteString(store.configStr).Bytes())
-	write(p.Reset().WriteByte(OP_MAXTOPICS).WriteUInt32(uint32(store.maxLiveTopics)).Bytes())
+	swapped := false
+	defer func() {
+		if !swapped {
+			f.Close()
+			os.Remove(path)
+		}
+	}()
 
-	n, err := dst.Seek(0, 1)
-	panicif(err != nil, "%v", err)
+	if _, err := f.Write(buf); err != nil {
+		return 0, 0, err
+	}
 
-	_, err = dst.Seek(4, 0)
-	panicif(err != nil, "%v", err)
+	// UpdateConfig and SetMaxLiveTopics append under configLock only
+	store.configLock.Lock()
+	defer store.configLock.Unlock()
+	store.Lock()
+	defer store.Unlock()
+
+	if tail := store.ptr - from; tail > 0 && store.utf8 {
+		if _, err := io.Copy(f, io.NewSectionReader(store.dataFile, from, tail)); err != nil {
+			return 0, 0, err
+		}
+	} else if tail > 0 {
+		// legacy strings can't be copied into a UTF-8 file, marshal again
+		buf = store.marshal()
+		if err := f.Truncate(0); err != nil {
+			return 0, 0, err
+		}
+		if _, err := f.WriteAt(buf, 0); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	size, err := f.Seek(0, 2)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var p buffer
+	if _, err := f.WriteAt(p.WriteUInt48(uint64(size)).Bytes(), 4); err != nil {
+		return 0, 0, err
+	}
+	if err := f.Sync(); err != nil {
+		return 0, 0, err
+	}
+	if err := os.Rename(path, store.dataFilePath); err != nil {
+		return 0, 0, err
+	}
 
-	write(p.Reset().WriteUInt48(uint64(n)).Bytes())
+	swapped = true
+	store.dataFile.Close()
+	store.dataFile = f
+	store.utf8 = true
+	from, store.ptr = store.ptr, size
+	if store.index != nil {
+		// offsets of the old file mean nothing now
+		store.index.from = 0
+	}
+	store.notifyAppend()
+	return from, size, nil
 }
 
 func (store *Store) SetMaxLiveTopics(num int) error {
@@ -175,7 +258,7 @@ func (store *Store) UpdateConfig(v interface{}) error {
 
 	buf, _ := json.Marshal(v)
 
-	var p buffer
+	p := buffer{utf8: store.utf8}
 	if err := store.append(p.WriteByte(OP_CONFIG).WriteString(string(buf)).Bytes()); err != nil {
 		json.Unmarshal([]byte(store.configStr), v)
 		return err
@@ -183,3 +266,171 @@ func (store *Store) UpdateConfig(v interface{}) error {
 	store.configStr = string(buf)
 	return nil
 }
+
+// movePost moves p to the end of dst and leaves a stub, the caller should hold the lock
+func (store *Store) movePost(p *Post, dst *Topic) *Post {
+	store.unindexPost(p)
+	user, ip := p.UserXor(), p.IPXor()
+
+	np := *p
+	np.ID = uint16(len(dst.Posts) + 1)
+	np.Topic = dst
+	np.T_Status = p.T_Status & POST_T_ISNSFW
+
+	if len(dst.Posts) == 0 {
+		dst.CreatedAt = np.CreatedAt
+	} else if np.CreatedAt > dst.ModifiedAt {
+		dst.ModifiedAt = np.CreatedAt
+	}
+
+	// ip and user are encrypted with the topic, see Post.aes128
+	np.ip, np.user = np.aes128(ip), np.aes128(user)
+	dst.Posts = append(dst.Posts, np)
+	store.redirects[p.LongID()] = np.LongID()
+
+	*p = Post{ID: p.ID, CreatedAt: p.CreatedAt, Status: POST_ISMOVED, Topic: p.Topic}
+	store.indexPost(&dst.Posts[len(dst.Posts)-1])
+	return &dst.Posts[len(dst.Posts)-1]
+}
+
+func (store *Store) redirectUnlocked(longID uint64) uint64 {
+	// posts may be moved more than once
+	for i := 0; i < 16; i++ {
+		to, ok := store.redirects[longID]
+		if !ok {
+			break
+		}
+		longID = to
+	}
+	return longID
+}
+
+// Redirect returns where the post is now, or longID itself if it has never been moved
+func (store *Store) Redirect(longID uint64) uint64 {
+	store.RLock()
+	defer store.RUnlock()
+	return store.redirectUnlocked(longID)
+}
+
+// MovePosts moves posts to the end of another topic, their old long IDs will be redirected to the new ones.
+// The first post of a topic can't be moved, use MergeTopic instead.
+func (store *Store) MovePosts(postLongIDs []uint64, dstTopicID uint32) error {
+	store.Lock()
+	defer store.Unlock()
+
+	dst := store.topicByIDUnlocked(dstTopicID)
+	if dst == nil {
+		return ErrInvalidTopic
+	}
+	return store.movePostsUnlocked(postLongIDs, dst, nil)
+}
+
+func (store *Store) movePostsUnlocked(postLongIDs []uint64, dst *Topic, p *buffer) error {
+	posts, dedup := make([]*Post, 0, len(postLongIDs)), map[*Post]bool{}
+	for _, id := range postLongIDs {
+		post, err := store.getPostPtrUnlocked(id)
+		if err != nil {
+			return err
+		}
+		if post.ID == 1 || post.IsMoved() || post.Topic == dst || dedup[post] {
+			return fmt.Errorf("can't move post %d", id)
+		}
+		posts = append(posts, post)
+		dedup[post] = true
+	}
+
+	if len(dst.Posts)+len(posts) > 4000 {
+		return errTooManyPosts
+	}
+
+	if p == nil {
+		p = &buffer{}
+	}
+	for _, post := range posts {
+		p.WriteByte(OP_MOVE).WriteUInt32(post.Topic.ID).WriteUInt16(post.ID).WriteUInt32(dst.ID)
+	}
+	if err := store.append(p.Bytes()); err != nil {
+		return err
+	}
+
+	for _, post := range posts {
+		store.movePost(post, dst)
+	}
+	return nil
+}
+
+// SplitTopic moves posts into a new topic, it returns the ID of the new topic
+func (store *Store) SplitTopic(subject string, postLongIDs []uint64) (uint32, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	if len(postLongIDs) == 0 {
+		return 0, fmt.Errorf("no posts to split")
+	}
+	if store.topicsCount == math.MaxUint32 {
+		return 0, fmt.Errorf("that day finally come")
+	}
+
+	topic := &Topic{
+		ID:      store.topicsCount + 1,
+		Subject: subject,
+		Posts:   make([]Post, 0),
+		store:   store,
+	}
+
+	// the new topic stays in the board of the first post
+	if src, _ := SplitID(postLongIDs[0]); store.topics[src] != nil {
+		topic.Board = store.topics[src].Board
+	}
+
+	// moved posts keep their times, the split itself is stamped
+	p := buffer{utf8: store.utf8}
+	stamp(&p).WriteByte(OP_TOPIC).WriteUInt32(topic.ID).WriteString(topic.Subject)
+	if topic.Board != "" {
+		p.WriteByte(OP_BOARD).WriteUInt32(topic.ID).WriteString(topic.Board)
+	}
+	if err := store.movePostsUnlocked(postLongIDs, topic, &p); err != nil {
+		return 0, err
+	}
+
+	store.topicsCount++
+	store.LiveTopicsNum++
+	store.topics[topic.ID] = topic
+	store.moveTopicToFront(topic)
+	return topic.ID, nil
+}
+
+// MergeTopic moves all posts of src to the end of dst, then purges src
+func (store *Store) MergeTopic(srcTopicID, dstTopicID uint32) error {
+	store.Lock()
+	defer store.Unlock()
+
+	src, dst := store.topicByIDUnlocked(srcTopicID), store.topicByIDUnlocked(dstTopicID)
+	if src == nil || dst == nil || src == dst {
+		return ErrInvalidTopic
+	}
+
+	var p buffer
+	posts := make([]*Post, 0, len(src.Posts))
+	for i := range src.Posts {
+		if post := &src.Posts[i]; !post.IsMoved() {
+			posts = append(posts, post)
+			p.WriteByte(OP_MOVE).WriteUInt32(src.ID).WriteUInt16(post.ID).WriteUInt32(dst.ID)
+		}
+	}
+
+	if len(dst.Posts)+len(posts) > 4000 {
+		return errTooManyPosts
+	}
+
+	p.WriteByte(OP_PURGE).WriteUInt32(src.ID)
+	if err := store.append(p.Bytes()); err != nil {
+		return err
+	}
+
+	for _, post := range posts {
+		store.movePost(post, dst)
+	}
+	store.unlinkTopic(src)
+	return nil
+}
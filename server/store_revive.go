@@ -0,0 +1,178 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// reviveTopic appends op with all ops of t and replays it, so the data file doesn't depend on the
+// archive or the trash which t was loaded from, the caller should hold the lock
+func (store *Store) reviveTopic(op byte, t *Topic) error {
+	p := buffer{utf8: store.utf8}
+	p.WriteByte(op).WriteUInt32(t.ID)
+	m := t.marshal(store.utf8)
+	p.p.Write(m.Bytes())
+	t.marshalFlags(&p)
+	p.WriteByte(OP_NOP)
+
+	if err := store.append(p.Bytes()); err != nil {
+		return err
+	}
+
+	r := &buffer{utf8: store.utf8}
+	r.SetReader(bytes.NewReader(p.Bytes()[1:]))
+	store.applyOp(op, r, func(string, ...interface{}) {})
+	return nil
+}
+
+// UnarchiveTopic moves the archived topic back to the front of the live list
+func (store *Store) UnarchiveTopic(topicID uint32) error {
+	store.Lock()
+	defer store.Unlock()
+
+	if store.topics[topicID] != nil {
+		return fmt.Errorf("topic %d is not archived", topicID)
+	}
+	t, err := store.loadArchived(topicID)
+	if err != nil {
+		return err
+	}
+	if err := store.reviveTopic(OP_UNARCHIVE, t); err != nil {
+		return err
+	}
+	if err := os.Remove(store.buildArchivePath(topicID)); err != nil {
+		return err
+	}
+	return store.unindexArchived(topicID)
+}
+
+func (store *Store) trashDir() string { return filepath.Join(filepath.Dir(store.dataFilePath), "trash") }
+
+func (store *Store) trashPath(topicID uint32) string {
+	return filepath.Join(store.trashDir(), strconv.Itoa(int(topicID)))
+}
+
+// trash saves the topic into the trash before it is purged, its mtime is when it was purged
+func (store *Store) trash(t *Topic) error {
+	buf := t.marshal(true)
+	t.marshalFlags(&buf)
+	return saveTopic(buf, store.trashPath(t.ID))
+}
+
+// UnpurgeTopic moves the purged topic from the trash back to the front of the live list
+func (store *Store) UnpurgeTopic(topicID uint32) error {
+	store.Lock()
+	defer store.Unlock()
+
+	if store.topics[topicID] != nil {
+		return fmt.Errorf("topic %d is not purged", topicID)
+	}
+	path := store.trashPath(topicID)
+	t, err := store.loadTopicFile(path, topicID)
+	if err != nil {
+		return err
+	}
+	if err := store.reviveTopic(OP_UNPURGE, t); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// TrashedTopic is a purged topic in the trash
+type TrashedTopic struct {
+	ID       uint32
+	Subject  string
+	PostsNum int
+	PurgedAt time.Time
+}
+
+// trashFiles lists topic IDs in the trash with their mtimes
+func (store *Store) trashFiles() (map[uint32]time.Time, error) {
+	res := map[uint32]time.Time{}
+	files, err := ioutil.ReadDir(store.trashDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return res, err
+	}
+
+	for _, fi := range files {
+		id, err := strconv.ParseUint(fi.Name(), 10, 32)
+		if err != nil {
+			continue
+		}
+		res[uint32(id)] = fi.ModTime()
+	}
+	return res, nil
+}
+
+// trashedTopics loads all topics in the trash, their mtimes are in PurgedAt
+func (store *Store) trashedTopics() (map[*Topic]time.Time, error) {
+	res := map[*Topic]time.Time{}
+	files, err := store.trashFiles()
+	for id, purgedAt := range files {
+		t, err := store.loadTopicFile(store.trashPath(id), id)
+		if err != nil {
+			continue
+		}
+		res[t] = purgedAt
+	}
+	return res, err
+}
+
+// TrashedTopics returns topics in the trash, latest purged first
+func (store *Store) TrashedTopics() ([]TrashedTopic, error) {
+	res := []TrashedTopic{}
+	topics, err := store.trashedTopics()
+	for t, purgedAt := range topics {
+		res = append(res, TrashedTopic{ID: t.ID, Subject: t.Subject, PostsNum: len(t.Posts), PurgedAt: purgedAt})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].PurgedAt.After(res[j].PurgedAt) })
+	return res, err
+}
+
+// EmptyTrash removes topics purged more than days ago, it returns the number of them.
+// onImageDelete is called with their images which no post refers to any more.
+// Trash files are listed and loaded without the lock, it is only held to release images and remove the file.
+func (store *Store) EmptyTrash(days int, onImageDelete func(*Image)) (int, error) {
+	files, err := store.trashFiles()
+	n, deadline := 0, time.Now().Add(-time.Duration(days)*24*time.Hour)
+	for id, purgedAt := range files {
+		if purgedAt.After(deadline) {
+			continue
+		}
+		t, err := store.loadTopicFile(store.trashPath(id), id)
+		if err != nil {
+			continue
+		}
+		if ok, err := store.removeTrashed(t, purgedAt, onImageDelete); err != nil {
+			return n, err
+		} else if ok {
+			n++
+		}
+	}
+	return n, err
+}
+
+// removeTrashed removes the topic from the trash unless it has been unpurged or purged again since purgedAt
+func (store *Store) removeTrashed(t *Topic, purgedAt time.Time, onImageDelete func(*Image)) (bool, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	path := store.trashPath(t.ID)
+	if fi, err := os.Stat(path); err != nil || !fi.ModTime().Equal(purgedAt) {
+		return false, nil
+	}
+	if err := os.Remove(path); err != nil {
+		return false, err
+	}
+	store.releaseTopicImages(t, onImageDelete)
+	return true, nil
+}
@@ -0,0 +1,331 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+	"unicode"
+)
+
+// textIndex maps bigrams of subjects and messages to long IDs of live posts,
+// deleted posts, moved stubs and archived topics are not in the index
+type textIndex struct {
+	postings map[uint32][]uint64
+	from     int64 // ops before this offset are already in the index, see loadIndex
+}
+
+func newTextIndex() *textIndex {
+	return &textIndex{postings: make(map[uint32][]uint64)}
+}
+
+// bigrams returns the sorted bigrams of text, letters are lowercased and whitespaces are word boundaries
+func bigrams(text string, max int) []uint32 {
+	m := make([]uint32, 0, len(text)/2)
+	lastr := rune(' ')
+	for _, r := range text {
+		if unicode.IsSpace(r) {
+			lastr = ' '
+			continue
+		}
+		r = unicode.ToLower(r)
+		if lastr != ' ' {
+			m = append(m, uint32(uint16(lastr))<<16+uint32(uint16(r)))
+			if max > 0 && len(m) >= max {
+				break
+			}
+		}
+		lastr = r
+	}
+
+	sort.Slice(m, func(i, j int) bool { return m[i] < m[j] })
+	res := m[:0]
+	for i, x := range m {
+		if i == 0 || x != m[i-1] {
+			res = append(res, x)
+		}
+	}
+	return res
+}
+
+// postText returns the searchable text of the post, the subject is searched as a part of the first post
+func postText(p *Post) string {
+	if p.ID == 1 {
+		return p.Topic.Subject + "\n" + p.Message
+	}
+	return p.Message
+}
+
+// indexing tells if ops being applied should update the index
+func (store *Store) indexing() bool {
+	return store.index != nil && store.ptr >= store.index.from
+}
+
+// indexPost adds the post into the index, the caller should hold the lock
+func (store *Store) indexPost(p *Post) {
+	if !store.indexing() || p.IsDeleted() || p.IsMoved() {
+		return
+	}
+	id := p.LongID()
+	for _, x := range bigrams(postText(p), 0) {
+		store.index.postings[x] = append(store.index.postings[x], id)
+	}
+}
+
+// unindexPost removes the post from the index, it should be called before the post is changed
+func (store *Store) unindexPost(p *Post) {
+	if !store.indexing() || p.IsDeleted() || p.IsMoved() {
+		return
+	}
+	id := p.LongID()
+	for _, x := range bigrams(postText(p), 0) {
+		ids := store.index.postings[x]
+		// recent posts are more likely to be changed, they are at the end
+		for i := len(ids) - 1; i >= 0; i-- {
+			if ids[i] == id {
+				ids[i] = ids[len(ids)-1]
+				ids = ids[:len(ids)-1]
+				break
+			}
+		}
+		if len(ids) == 0 {
+			delete(store.index.postings, x)
+		} else {
+			store.index.postings[x] = ids
+		}
+	}
+}
+
+// Search returns posts matching q from start, newest first, and the number of all matches.
+// Text is looked up in the indexes of live and archived topics, other queries scan live topics for up to timeout nanoseconds,
+// so do phrases in archived topics.
+func (store *Store) Search(q *Query, start, length int, timeout int64) ([]Post, int) {
+	res := make([]Post, 0)
+	m := q.bigrams()
+	if len(m) == 0 && (q.Text != "" || len(q.Phrases) > 0) {
+		// too short to search
+		return res, 0
+	}
+
+	loaded := map[uint32]*Topic{}
+	ids := store.searchLive(q, m, timeout)
+	archived := store.searchArchived(q, m, loaded, timeout)
+	ids = append(ids, archived...)
+	sort.Slice(ids, func(i, j int) bool { return ids[i] > ids[j] })
+
+	isArchived := make(map[uint64]bool, len(archived))
+	for _, id := range archived {
+		isArchived[id] = true
+	}
+
+	for i := start; i >= 0 && i < len(ids) && i < start+length; i++ {
+		if !isArchived[ids[i]] {
+			store.RLock()
+			if p, err := store.getPostPtrUnlocked(ids[i]); err == nil {
+				res = append(res, *p)
+			}
+			store.RUnlock()
+			continue
+		}
+
+		tid, pid := SplitID(ids[i])
+		t := loaded[tid]
+		if t == nil {
+			var err error
+			if t, err = store.loadArchived(tid); err != nil {
+				continue
+			}
+			loaded[tid] = t
+		}
+		if int(pid) <= len(t.Posts) {
+			res = append(res, t.Posts[pid-1])
+		}
+	}
+	return res, len(ids)
+}
+
+func (store *Store) searchLive(q *Query, m []uint32, timeout int64) []uint64 {
+	store.RLock()
+	defer store.RUnlock()
+
+	ids := []uint64{}
+	if q.indexed() && store.index != nil {
+		counts := map[uint64]int{}
+		for _, x := range m {
+			for _, id := range store.index.postings[x] {
+				counts[id]++
+			}
+		}
+		for id, n := range counts {
+			if n < len(m)/2+1 {
+				continue
+			}
+			if p, err := store.getPostPtrUnlocked(id); err == nil && q.match(p) {
+				ids = append(ids, id)
+			}
+		}
+		return ids
+	}
+
+	scan := func(t *Topic) {
+		for i := range t.Posts {
+			p := &t.Posts[i]
+			if !q.match(p) {
+				continue
+			}
+			if len(m) > 0 {
+				n := 0
+				for _, x := range bigrams(postText(p), 0) {
+					if xi := sort.Search(len(m), func(i int) bool { return m[i] >= x }); xi < len(m) && m[xi] == x {
+						n++
+					}
+				}
+				if n < len(m)/2+1 {
+					continue
+				}
+			}
+			ids = append(ids, p.LongID())
+		}
+	}
+
+	switch {
+	case q.Topic > 0:
+		if t := store.topics[q.Topic]; t != nil {
+			scan(t)
+		}
+	case q.Tag != "":
+		for id := range store.tags[q.Tag] {
+			scan(store.topics[id])
+		}
+	default:
+		deadline := time.Now().UnixNano() + timeout
+		for t := store.rootTopic.Next; t != store.endTopic && time.Now().UnixNano() < deadline; t = t.Next {
+			scan(t)
+		}
+	}
+	return ids
+}
+
+func (store *Store) indexPath() string { return store.dataFilePath + ".index" }
+
+// SaveIndex writes the search index beside the data file, so the next startup only indexes ops after it.
+// Postings are changed in place, so they are serialized under the read lock, writing and syncing go without it.
+func (store *Store) SaveIndex() error {
+	p, err := store.encodeIndex()
+	if err != nil {
+		return err
+	}
+
+	path := store.indexPath()
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(p.Bytes()); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (store *Store) encodeIndex() (*buffer, error) {
+	store.RLock()
+	defer store.RUnlock()
+
+	if store.dataFile == nil || store.index == nil {
+		return nil, fmt.Errorf("store not ready")
+	}
+
+	d, err := digest(store.dataFile, store.ptr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &buffer{utf8: true}
+	p.WriteString("fofou-index").WriteUInt64(uint64(store.ptr)).WriteString(d).WriteUInt32(uint32(len(store.index.postings)))
+	for x, ids := range store.index.postings {
+		p.WriteUInt32(x).WriteUInt32(uint32(len(ids)))
+		for _, id := range ids {
+			p.WriteUInt64(id)
+		}
+	}
+	return p, nil
+}
+
+// loadIndex reads the saved index if it matches the data file, otherwise the index is built from scratch by loadDB
+func (store *Store) loadIndex() (err error) {
+	store.index = newTextIndex()
+	defer func() {
+		if err != nil {
+			store.index = newTextIndex()
+		}
+	}()
+
+	fi, err := os.Open(store.indexPath())
+	if err != nil {
+		return err
+	}
+	defer fi.Close()
+
+	fd, err := os.Open(store.dataFilePath)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	r := &buffer{utf8: true}
+	r.SetReader(bufio.NewReaderSize(fi, 1024*1024))
+
+	magic, err := r.ReadString()
+	if err != nil || magic != "fofou-index" {
+		return fmt.Errorf("invalid index file")
+	}
+	from, err := r.ReadUInt64()
+	if err != nil {
+		return err
+	}
+	d, err := r.ReadString()
+	if err != nil {
+		return err
+	}
+
+	size, _, err := readHeader(fd)
+	if err != nil {
+		return err
+	}
+	if int64(from) < 16 || int64(from) > size {
+		return ErrLogMismatch
+	}
+	if x, err := digest(fd, int64(from)); err != nil {
+		return err
+	} else if x != d {
+		return ErrLogMismatch
+	}
+
+	n, err := r.ReadUInt32()
+	if err != nil {
+		return err
+	}
+	for i := uint32(0); i < n; i++ {
+		x, err1 := r.ReadUInt32()
+		ln, err2 := r.ReadUInt32()
+		if err1 != nil || err2 != nil {
+			return io.ErrUnexpectedEOF
+		}
+		ids := make([]uint64, ln)
+		for j := range ids {
+			if ids[j], err = r.ReadUInt64(); err != nil {
+				return err
+			}
+		}
+		store.index.postings[x] = ids
+	}
+	store.index.from = int64(from)
+	return nil
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var rxTag = regexp.MustCompile(`^[\p{L}\p{N}_-]{1,32}$`)
+
+// NormalizeTag lowercases the tag, it returns "" if the tag contains invalid chars
+func NormalizeTag(tag string) string {
+	tag = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(tag), "#")))
+	if !rxTag.MatchString(tag) {
+		return ""
+	}
+	return tag
+}
+
+func (t *Topic) HasTag(tag string) bool {
+	i := sort.SearchStrings(t.Tags, tag)
+	return i < len(t.Tags) && t.Tags[i] == tag
+}
+
+// setTag adds or removes the tag of the topic and updates the index if the topic is live
+func (store *Store) setTag(t *Topic, tag string, add bool) {
+	i := sort.SearchStrings(t.Tags, tag)
+	found := i < len(t.Tags) && t.Tags[i] == tag
+
+	// copies of the topic may share the old slice, always make a new one
+	switch {
+	case add && !found:
+		tags := make([]string, 0, len(t.Tags)+1)
+		t.Tags = append(append(append(tags, t.Tags[:i]...), tag), t.Tags[i:]...)
+	case !add && found:
+		t.Tags = append(t.Tags[:i:i], t.Tags[i+1:]...)
+	}
+
+	if store.topics[t.ID] != t {
+		return
+	}
+
+	m := store.tags[tag]
+	if add {
+		if m == nil {
+			m = make(map[uint32]bool)
+			store.tags[tag] = m
+		}
+		m[t.ID] = true
+	} else if delete(m, t.ID); len(m) == 0 {
+		delete(store.tags, tag)
+	}
+}
+
+// untagAll removes the topic from the index, its tags are kept
+func (store *Store) untagAll(t *Topic) {
+	for _, tag := range t.Tags {
+		if m := store.tags[tag]; m != nil {
+			if delete(m, t.ID); len(m) == 0 {
+				delete(store.tags, tag)
+			}
+		}
+	}
+}
+
+// TagTopic adds or removes tags of the topic
+func (store *Store) TagTopic(topicID uint32, tags []string, add bool) error {
+	store.Lock()
+	defer store.Unlock()
+
+	topic := store.topicByIDUnlocked(topicID)
+	if topic == nil {
+		return ErrInvalidTopic
+	}
+
+	op := byte(OP_TAG)
+	if !add {
+		op = OP_UNTAG
+	}
+
+	p, changed := buffer{utf8: store.utf8}, []string{}
+	for _, tag := range tags {
+		if tag = NormalizeTag(tag); tag == "" {
+			return fmt.Errorf("invalid tag")
+		}
+		if topic.HasTag(tag) != add {
+			p.WriteByte(op).WriteUInt32(topicID).WriteString(tag)
+			changed = append(changed, tag)
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	if len(topic.Tags)+len(changed) > 16 && add {
+		return fmt.Errorf("too many tags")
+	}
+
+	if err := store.append(p.Bytes()); err != nil {
+		return err
+	}
+	for _, tag := range changed {
+		store.setTag(topic, tag, add)
+	}
+	return nil
+}
+
+// TaggedNum returns the number of live topics with the tag
+func (store *Store) TaggedNum(tag string) int {
+	store.RLock()
+	defer store.RUnlock()
+	return len(store.tags[tag])
+}
+
+// Tags returns all tags of live topics and their numbers of topics
+func (store *Store) Tags() map[string]int {
+	store.RLock()
+	defer store.RUnlock()
+
+	res := make(map[string]int, len(store.tags))
+	for tag, m := range store.tags {
+		res[tag] = len(m)
+	}
+	return res
+}
+
+// GetTaggedTopics returns live topics with the tag in the order of GetTopics, from the tag index
+func (store *Store) GetTaggedTopics(tag string, start, length int, mapper func(*Topic) Topic) []Topic {
+	store.RLock()
+	defer store.RUnlock()
+
+	topics := make([]*Topic, 0, len(store.tags[tag]))
+	for id := range store.tags[tag] {
+		topics = append(topics, store.topics[id])
+	}
+	sort.Slice(topics, func(i, j int) bool {
+		if a, b := topics[i], topics[j]; a.Sticky != b.Sticky {
+			return a.Sticky
+		}
+		return topics[i].bumped > topics[j].bumped
+	})
+
+	res := make([]Topic, 0, length)
+	for i := start; i < len(topics) && len(res) < length; i++ {
+		res = append(res, mapper(topics[i]))
+	}
+	return res
+}
+
+// TagFilter returns the filter of topics with the tag
+func TagFilter(tag string) func(*Topic) bool {
+	return func(t *Topic) bool { return t.HasTag(tag) }
+}
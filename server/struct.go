@@ -15,6 +15,7 @@ const (
 	POST_ISDELETE = 1 << iota // used in archive only, normal deletion will have OP_DELETE
 	POST_SHOWID
 	POST_ISSAGE
+	POST_ISMOVED // a stub left by OP_MOVE, the post is now somewhere else
 )
 
 const (
@@ -36,15 +37,44 @@ type Image struct {
 type Post struct {
 	Message   string
 	Image     *Image
+	Revisions []Revision // previous messages, oldest first
 	user      [8]byte
 	ip        [8]byte
 	CreatedAt uint32
+	EditedAt  uint32
 	ID        uint16
 	Status    byte
 	T_Status  byte
 	Topic     *Topic
 }
 
+// Revision is a previous message of an edited post
+type Revision struct {
+	Message   string
+	CreatedAt uint32
+}
+
+func (r *Revision) Date() string {
+	return time.Unix(int64(r.CreatedAt), 0).UTC().Add(8 * time.Hour).Format(stdTimeFormat)
+}
+
+func (p *Post) edit(msg string, editedAt uint32) {
+	createdAt := p.EditedAt
+	if createdAt == 0 {
+		createdAt = p.CreatedAt
+	}
+	p.Revisions = append(p.Revisions, Revision{Message: p.Message, CreatedAt: createdAt})
+	p.Message, p.EditedAt = msg, editedAt
+}
+
+// Original returns the message before any edits
+func (p *Post) Original() string {
+	if len(p.Revisions) > 0 {
+		return p.Revisions[0].Message
+	}
+	return p.Message
+}
+
 func (p *Post) T_SetStatus(v byte) { p.T_Status |= v }
 
 func (p *Post) SetStatus(v byte) { p.Status |= v }
@@ -69,10 +99,16 @@ func (p *Post) IsDeleted() bool { return p.Status&POST_ISDELETE > 0 }
 
 func (p *Post) IsSaged() bool { return p.Status&POST_ISSAGE > 0 }
 
+func (p *Post) IsMoved() bool { return p.Status&POST_ISMOVED > 0 }
+
 func (p *Post) Date() string {
 	return time.Unix(int64(p.CreatedAt), 0).UTC().Add(8 * time.Hour).Format(stdTimeFormat)
 }
 
+func (p *Post) EditDate() string {
+	return time.Unix(int64(p.EditedAt), 0).UTC().Add(8 * time.Hour).Format(stdTimeFormat)
+}
+
 func (p *Post) MessageHTML() string { return markup.Do(p.Message, true, 0) }
 
 func (p *Post) aes128(a [8]byte) [8]byte {
@@ -126,6 +162,10 @@ func (p *Post) LongID() uint64 {
 	return ti<<14 + pi>>8<<10 + 1<<9 + (pi>>4&0xf)<<5 + 1<<4 + (pi & 0xf)
 }
 
+func LongID(topicID uint32, postID uint16) uint64 {
+	return (&Post{ID: postID, Topic: &Topic{ID: topicID}}).LongID()
+}
+
 func SplitID(longid uint64) (uint32, uint16) {
 	x, y := longid>>9&1, longid>>4&1
 	if x == 0 && y == 0 {
@@ -151,10 +191,17 @@ type Topic struct {
 	CreatedAt  uint32
 	ModifiedAt uint32
 	Subject    string
+	Board      string
+	Tags       []string // sorted
 	Next       *Topic
 	Prev       *Topic
 	Posts      []Post
 
+	ContinuedFrom uint32 // the full topic this one continues
+	ContinuedBy   uint32
+
+	bumped uint64 // the order in the live list, see moveTopicToFront
+
 	T_TotalPosts uint16
 	T_IsAdmin    bool
 	T_IsExpand   bool
@@ -190,6 +237,7 @@ type ForumConfig struct {
 	NoImageUpload  bool
 	NoRecaptcha    bool
 	MaxImageSize   int
+	MaxImagePixels int // megapixels
 	MaxSubjectLen  int
 	MaxMessageLen  int
 	MinMessageLen  int
@@ -199,6 +247,13 @@ type ForumConfig struct {
 	TopicsPerPage  int
 	URL            string
 	Announcement   string
+	EditWindow     int // seconds
+	AutoContinue   bool
+	BumpLimit      int // posts before a topic is continued
+	TrashDays      int // days before purged topics are removed from the trash
+	ArchiveEvery   int // minutes between archivings
+	ArchiveIdle    int // days before topics without new posts are archived, 0 to disable
+	Boards         []Board
 
 	// omit
 	Salt            [16]byte `json:"-"`
@@ -213,9 +268,76 @@ func (config *ForumConfig) CorrectValues() {
 	checkInt(&config.MinMessageLen, 3)
 	checkInt(&config.SearchTimeout, 100)
 	checkInt(&config.MaxImageSize, 4)
+	checkInt(&config.MaxImagePixels, 24)
 	checkInt(&config.Cooldown, 2)
 	checkInt(&config.PostsPerPage, 20)
 	checkInt(&config.TopicsPerPage, 15)
+	if config.EditWindow != -1 {
+		// 0 is unset, -1 turns editing by authors off
+		checkInt(&config.EditWindow, 600)
+	}
+	checkInt(&config.BumpLimit, 4000)
+	checkInt(&config.TrashDays, 7)
+	checkInt(&config.ArchiveEvery, 60)
+
+	if config.Boards == nil {
+		// topics used to be tagged by subjects starting with "!!"
+		config.Boards = []Board{{Name: TaggedBoard, Title: "!!标记"}}
+	}
+}
+
+// TaggedBoard is where topics with "!!" subjects are migrated to
+const TaggedBoard = "tagged"
+
+// Board is a list of topics, non-zero fields override the forum's
+type Board struct {
+	Name          string
+	Title         string
+	Cooldown      int
+	NoImageUpload bool
+	MaxSubjectLen int
+	MaxMessageLen int
+	MinMessageLen int
+	MaxLiveTopics int // archive old topics beyond it, 0 for no limit
+}
+
+// ArchivePolicy returns the policy of archiving in the config
+func (config *ForumConfig) ArchivePolicy() ArchivePolicy {
+	p := ArchivePolicy{IdleDays: config.ArchiveIdle, BoardLimits: map[string]int{}}
+	for _, b := range config.Boards {
+		if b.MaxLiveTopics > 0 {
+			p.BoardLimits[b.Name] = b.MaxLiveTopics
+		}
+	}
+	return p
+}
+
+// Board returns the config of board with its overrides applied, "" is the main board
+func (config *ForumConfig) Board(name string) (ForumConfig, bool) {
+	c := *config
+	if name == "" {
+		return c, true
+	}
+	for _, b := range config.Boards {
+		if b.Name != name {
+			continue
+		}
+		if b.Title != "" {
+			c.Title = b.Title + " - " + c.Title
+		}
+		override := func(i *int, v int) {
+			if v > 0 {
+				*i = v
+			}
+		}
+		override(&c.Cooldown, b.Cooldown)
+		override(&c.MaxSubjectLen, b.MaxSubjectLen)
+		override(&c.MaxMessageLen, b.MaxMessageLen)
+		override(&c.MinMessageLen, b.MinMessageLen)
+		c.NoImageUpload = c.NoImageUpload || b.NoImageUpload
+		return c, true
+	}
+	return c, false
 }
 
 func (config *ForumConfig) SetSalt(v string) [16]byte {
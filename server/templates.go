@@ -20,10 +20,11 @@ var (
 	TmplHelp    = "help.html"
 	TmplFooter  = "footer.html"
 	TmplBrowser = "imagesbrowser.html"
+	TmplArchive = "archive.html"
 )
 
 var (
-	templateNames = []string{TmplForum, TmplTopic, TmplTopic1, TmplPosts, TmplNewPost, TmplLogs, TmplFooter, TmplHelp, TmplBrowser, "header.html", "post1.html"}
+	templateNames = []string{TmplForum, TmplTopic, TmplTopic1, TmplPosts, TmplNewPost, TmplLogs, TmplFooter, TmplHelp, TmplBrowser, TmplArchive, "header.html", "post1.html"}
 	templatePaths []string
 	templates     *template.Template
 	tmplMutex     sync.RWMutex
@@ -77,6 +77,7 @@ function _submit(btn, msg, callback) {
         form.append('message', $('#message').val());
         form.append('image', $('#select-image').get(0).files[0]);
         form.append('topic', window.TOPIC_ID || 0);
+        form.append('board', window.BOARD || "");
         form.append('uuid', $('#newpost').attr('uuid'));
         form.append('options', options);
         try {
@@ -110,7 +111,12 @@ function _submit(btn, msg, callback) {
                     "image-upload-failed": "图片上传失败",
                     "image-upload-disabled": "禁止上传图片",
                     "image-invalid-format": "图片格式不支持",
+                    "image-too-large": "图片尺寸过大",
                     "image-disk-error": "图片上传失败",
+                    "edit-expired": "无法编辑，已超出编辑时限",
+                    "edit-denied": "无法编辑他人或已删除的帖子",
+                    "edit-not-found": "帖子不存在",
+                    "edit-failed": "编辑失败",
                 })[resp.error]);
                 $("#newpost").attr("uuid", 'xxxxxxxxxxxx4xxxyxxxxxxxxxxxxxxx'.replace(/[xy]/g, function(c) {
                     var r = Math.random() * 16 | 0, v = c == 'x' ? r : (r & 0x3 | 0x8);